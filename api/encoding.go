@@ -0,0 +1,161 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/fsufitch/censys-takehome/database"
+)
+
+// Entry is the JSON form of a scan entry
+type Entry struct {
+	IP          string            `json:"ip"`
+	Port        uint32            `json:"port"`
+	Service     string            `json:"service"`
+	Updated     time.Time         `json:"updated"`
+	Data        string            `json:"data"`
+	Encoding    string            `json:"encoding"`      // How data was rendered from the response; utf-8 if it is exact
+	Raw         []byte            `json:"raw,omitempty"` // Base64 of the exact response, if data is not exact
+	MessageID   string            `json:"message_id,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	FirstSeen   time.Time         `json:"first_seen"`
+	LastChanged time.Time         `json:"last_changed"`
+	TimesSeen   int               `json:"times_seen"`
+}
+
+func NewEntry(e database.ScanEntry) Entry {
+	return Entry{
+		IP:          e.IP.String(),
+		Port:        e.Port,
+		Service:     e.Service,
+		Updated:     e.Updated,
+		Data:        e.Data,
+		Encoding:    e.Encoding,
+		Raw:         e.Raw,
+		MessageID:   e.MessageID,
+		Metadata:    e.Metadata,
+		FirstSeen:   e.FirstSeen,
+		LastChanged: e.LastChanged,
+		TimesSeen:   e.TimesSeen,
+	}
+}
+
+func NewEntries(entries []database.ScanEntry) []Entry {
+	out := make([]Entry, len(entries))
+	for i, e := range entries {
+		out[i] = NewEntry(e)
+	}
+	return out
+}
+
+// cursor is what an opaque pagination cursor decodes to. It remembers the order it was made for, so that it can't be
+// used to continue a listing in a different order.
+type cursor struct {
+	IP         string    `json:"i"`
+	Port       uint32    `json:"p"`
+	Service    string    `json:"s"`
+	Updated    time.Time `json:"u,omitempty"`
+	Sort       string    `json:"o"`
+	Descending bool      `json:"d,omitempty"`
+}
+
+func encodeCursor(q database.EntryQuery, next *database.EntryCursor) string {
+	if next == nil {
+		return ""
+	}
+	data, _ := json.Marshal(cursor{
+		IP:         next.Key.IP,
+		Port:       next.Key.Port,
+		Service:    next.Key.Service,
+		Updated:    next.Updated,
+		Sort:       q.Sort.String(),
+		Descending: q.Descending,
+	})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor continues the query from the cursor, if there is one
+func decodeCursor(s string, q *database.EntryQuery) error {
+	if s == "" {
+		return nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return errBadRequest("malformed cursor")
+	}
+	c := cursor{}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return errBadRequest("malformed cursor")
+	}
+	ip := net.ParseIP(c.IP)
+	if ip == nil {
+		return errBadRequest("malformed cursor")
+	}
+	if c.Sort != q.Sort.String() || c.Descending != q.Descending {
+		return errBadRequest("cursor is for a different sort order")
+	}
+	q.After = &database.EntryCursor{
+		Key:     database.ScanEntryKey{IP: ip.String(), Port: c.Port, Service: c.Service},
+		Updated: c.Updated,
+	}
+	return nil
+}
+
+// Page is the JSON form of a page of entries
+type Page struct {
+	Entries    []Entry `json:"entries"`
+	NextCursor string  `json:"next_cursor,omitempty"` // Pass as ?cursor= to get the next page; absent on the last page
+}
+
+// Error is the body of every non-2xx response
+type Error struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Code    string `json:"code"` // Stable, machine-readable: bad_request, bad_query, not_found, or internal
+	Message string `json:"message"`
+}
+
+// httpError is an error that is safe to show to API clients as-is
+type httpError struct {
+	Status int
+	Code   string
+	Msg    string
+}
+
+func (e httpError) Error() string { return e.Msg }
+
+func errBadRequest(format string, args ...any) error {
+	return httpError{Status: http.StatusBadRequest, Code: "bad_request", Msg: fmt.Sprintf(format, args...)}
+}
+
+// errBadQuery reports a search query syntax error, along with where it is
+func errBadQuery(err error) error {
+	return httpError{Status: http.StatusBadRequest, Code: "bad_query", Msg: err.Error()}
+}
+
+func errNotFound(format string, args ...any) error {
+	return httpError{Status: http.StatusNotFound, Code: "not_found", Msg: fmt.Sprintf(format, args...)}
+}
+
+func (srv *Server) writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeError responds with the error body; anything that is not an httpError is logged and hidden behind a 500
+func (srv *Server) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	herr := httpError{}
+	if !errors.As(err, &herr) {
+		srv.Log().Err(err).Str("path", r.URL.Path).Msg("request failed")
+		herr = httpError{Status: http.StatusInternalServerError, Code: "internal", Msg: "internal error"}
+	}
+	srv.writeJSON(w, herr.Status, Error{Error: ErrorDetail{Code: herr.Code, Message: herr.Msg}})
+}
@@ -0,0 +1,180 @@
+package api
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsufitch/censys-takehome/database"
+	"github.com/fsufitch/censys-takehome/search"
+)
+
+// Paging defaults, for when the configuration does not say otherwise
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// pageQuery reads the parameters shared by every listing: sort, order, limit and cursor
+func (srv *Server) pageQuery(r *http.Request) (database.EntryQuery, error) {
+	params := r.URL.Query()
+	q := database.EntryQuery{Limit: srv.Config.PageSize}
+	if q.Limit <= 0 {
+		q.Limit = defaultPageSize
+	}
+
+	sort, err := database.ParseEntrySort(params.Get("sort"))
+	if err != nil {
+		return q, errBadRequest("sort must be key or updated")
+	}
+	q.Sort = sort
+
+	switch strings.ToLower(params.Get("order")) {
+	case "", "asc":
+	case "desc":
+		q.Descending = true
+	default:
+		return q, errBadRequest("order must be asc or desc")
+	}
+
+	if s := params.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		max := srv.Config.MaxPageSize
+		if max <= 0 {
+			max = maxPageSize
+		}
+		if err != nil || limit < 1 || limit > max {
+			return q, errBadRequest("limit must be between 1 and %d", max)
+		}
+		q.Limit = limit
+	}
+
+	return q, decodeCursor(params.Get("cursor"), &q)
+}
+
+// parseTime accepts RFC 3339 timestamps, or Unix seconds like the scans themselves. Times are stored as local wall
+// clock time, so they are converted to local time to compare the same instant.
+func parseTime(name string, s string) (time.Time, error) {
+	if unix, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, errBadRequest("%s must be an RFC 3339 timestamp or Unix seconds", name)
+	}
+	return t.Local(), nil
+}
+
+func parseIP(s string) (net.IP, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, errBadRequest("invalid IP address %q", s)
+	}
+	return ip, nil
+}
+
+func parsePort(s string) (uint32, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || port == 0 {
+		return 0, errBadRequest("port must be between 1 and 65535")
+	}
+	return uint32(port), nil
+}
+
+func (srv *Server) listPage(w http.ResponseWriter, r *http.Request, q database.EntryQuery) {
+	page, err := srv.ScanEntryDAO.ListEntries(r.Context(), q)
+	if err != nil {
+		srv.writeError(w, r, err)
+		return
+	}
+	srv.writeJSON(w, http.StatusOK, Page{Entries: NewEntries(page.Entries), NextCursor: encodeCursor(q, page.Next)})
+}
+
+// handleHost lists every service recorded on one IP
+func (srv *Server) handleHost(w http.ResponseWriter, r *http.Request) {
+	q, err := srv.pageQuery(r)
+	if err != nil {
+		srv.writeError(w, r, err)
+		return
+	}
+	if q.IP, err = parseIP(r.PathValue("ip")); err != nil {
+		srv.writeError(w, r, err)
+		return
+	}
+	srv.listPage(w, r, q)
+}
+
+// handleServices lists services across hosts, filtered by port, service, CIDR, update time and search query
+func (srv *Server) handleServices(w http.ResponseWriter, r *http.Request) {
+	q, err := srv.pageQuery(r)
+	if err != nil {
+		srv.writeError(w, r, err)
+		return
+	}
+
+	params := r.URL.Query()
+	if s := params.Get("port"); s != "" {
+		if q.Port, err = parsePort(s); err != nil {
+			srv.writeError(w, r, err)
+			return
+		}
+	}
+	q.Service = params.Get("service")
+	if s := params.Get("cidr"); s != "" {
+		if _, q.CIDR, err = net.ParseCIDR(s); err != nil {
+			srv.writeError(w, r, errBadRequest("invalid CIDR %q", s))
+			return
+		}
+	}
+	if s := params.Get("since"); s != "" {
+		if q.UpdatedSince, err = parseTime("since", s); err != nil {
+			srv.writeError(w, r, err)
+			return
+		}
+	}
+	if s := params.Get("until"); s != "" {
+		if q.UpdatedUntil, err = parseTime("until", s); err != nil {
+			srv.writeError(w, r, err)
+			return
+		}
+	}
+	if s := params.Get("q"); s != "" {
+		parsed, err := search.Parse(s)
+		if err != nil {
+			srv.writeError(w, r, errBadQuery(err))
+			return
+		}
+		q.Condition = parsed
+	}
+
+	srv.listPage(w, r, q)
+}
+
+// handleEntry returns a single service on a single host
+func (srv *Server) handleEntry(w http.ResponseWriter, r *http.Request) {
+	ip, err := parseIP(r.PathValue("ip"))
+	if err != nil {
+		srv.writeError(w, r, err)
+		return
+	}
+	port, err := parsePort(r.PathValue("port"))
+	if err != nil {
+		srv.writeError(w, r, err)
+		return
+	}
+	key := database.ScanEntryKey{IP: ip.String(), Port: port, Service: r.PathValue("service")}
+
+	entry, err := srv.ScanEntryDAO.GetEntry(r.Context(), key)
+	if errors.Is(err, database.ErrScanEntryNotFound) {
+		srv.writeError(w, r, errNotFound("no such entry"))
+		return
+	}
+	if err != nil {
+		srv.writeError(w, r, err)
+		return
+	}
+	srv.writeJSON(w, http.StatusOK, NewEntry(entry))
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/fsufitch/censys-takehome/config"
+	"github.com/fsufitch/censys-takehome/database"
+	"github.com/fsufitch/censys-takehome/logging"
+	"github.com/google/wire"
+)
+
+var ErrAPI = errors.New("api")
+
+//go:embed openapi.yaml
+var openAPIDocument []byte
+
+// Server serves read-only access to the recorded scan data as JSON over HTTP
+type Server struct {
+	Context      context.Context
+	Config       config.APIConfiguration
+	Log          logging.LogFunc
+	ScanEntryDAO *database.ScanEntryDAO
+}
+
+func (srv *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /hosts/{ip}", srv.handleHost)
+	mux.HandleFunc("GET /services", srv.handleServices)
+	mux.HandleFunc("GET /entries/{ip}/{port}/{service}", srv.handleEntry)
+	mux.HandleFunc("GET /openapi.yaml", srv.handleOpenAPI)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		srv.writeError(w, r, errNotFound("no such endpoint"))
+	})
+	return mux
+}
+
+// Run serves until the context is done
+func (srv *Server) Run() error {
+	httpServer := &http.Server{
+		Addr:        srv.Config.Address,
+		Handler:     srv.Handler(),
+		BaseContext: func(net.Listener) context.Context { return srv.Context },
+	}
+
+	go func() {
+		<-srv.Context.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			srv.Log().Err(err).Msg("error shutting down api server")
+		}
+	}()
+
+	srv.Log().Info().Str("address", srv.Config.Address).Msg("api server starting")
+	if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("%w: %w", ErrAPI, err)
+	}
+	srv.Log().Warn().Msg("api server shutting down")
+	return nil
+}
+
+func (srv *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(openAPIDocument)
+}
+
+var ProvideAPI = wire.NewSet(
+	wire.Struct(new(Server), "*"),
+)
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/fsufitch/censys-takehome/config"
+	cli "github.com/urfave/cli/v2"
+)
+
+func APICommand() *cli.Command {
+	return &cli.Command{
+		Name:  "api",
+		Usage: "serve the recorded scan data as JSON over HTTP",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "address",
+				EnvVars: []string{"API_ADDRESS"},
+				Value:   ":8081",
+				Usage:   "address to serve the API on",
+			},
+			&cli.IntFlag{
+				Name:    "page-size",
+				EnvVars: []string{"API_PAGE_SIZE"},
+				Value:   100,
+				Usage:   "entries per page, unless a request asks otherwise",
+			},
+			&cli.IntFlag{
+				Name:    "max-page-size",
+				EnvVars: []string{"API_MAX_PAGE_SIZE"},
+				Value:   1000,
+				Usage:   "most entries a request may ask for per page",
+			},
+		},
+		Action: APIMain,
+	}
+}
+
+func APIMain(cctx *cli.Context) error {
+	server, cleanup, err := initializeAPI(cctx.Context, postgresConfiguration(cctx), loggingConfiguration(cctx), config.APIConfiguration{
+		Address:     cctx.String("address"),
+		PageSize:    cctx.Int("page-size"),
+		MaxPageSize: cctx.Int("max-page-size"),
+	})
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	return server.Run()
+}
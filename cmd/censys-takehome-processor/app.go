@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/fsufitch/censys-takehome/config"
 	cli "github.com/urfave/cli/v2"
@@ -68,6 +70,47 @@ func NewCLI() *cli.App {
 				Value:   "scan-sub",
 				Usage:   "what Pubsub topic to receive data from",
 			},
+			&cli.StringFlag{
+				Name:    "dead-letter-topic",
+				EnvVars: []string{"PUBSUB_DEAD_LETTER_TOPIC_ID"},
+				Usage:   "what Pubsub topic to also publish undecodable messages to; if unset, they are only kept in the database",
+			},
+
+			&cli.IntFlag{
+				Name:    "batch-size",
+				EnvVars: []string{"BATCH_SIZE"},
+				Value:   100,
+				Usage:   "how many entries to write to the database in a single transaction",
+			},
+			&cli.DurationFlag{
+				Name:    "batch-latency",
+				EnvVars: []string{"BATCH_MAX_LATENCY"},
+				Value:   250 * time.Millisecond,
+				Usage:   "longest time an entry may wait for its batch to fill up before being written anyway",
+			},
+
+			&cli.DurationFlag{
+				Name:    "max-clock-skew",
+				EnvVars: []string{"MAX_CLOCK_SKEW"},
+				Value:   5 * time.Minute,
+				Usage:   "how far in the future scan timestamps may be before they are rejected",
+			},
+			&cli.DurationFlag{
+				Name:    "max-scan-age",
+				EnvVars: []string{"MAX_SCAN_AGE"},
+				Usage:   "how far in the past scan timestamps may be before they are dropped (0 for no limit)",
+			},
+			&cli.StringSliceFlag{
+				Name:    "allowed-services",
+				EnvVars: []string{"ALLOWED_SERVICES"},
+				Usage:   "service names to accept, case-insensitively (if unset, any non-empty name is accepted)",
+			},
+
+			&cli.StringFlag{
+				Name:    "change-sink",
+				EnvVars: []string{"CHANGE_SINK"},
+				Usage:   "where the server emits events when a service's response changes: postgres, pubsub or file (if unset, none are emitted, and no command records changes for them)",
+			},
 
 			&cli.BoolFlag{
 				Name:    "debug",
@@ -85,32 +128,157 @@ func NewCLI() *cli.App {
 			{
 				Name:   "server",
 				Action: ServerMain,
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:    "monitoring-address",
+						EnvVars: []string{"MONITORING_ADDRESS"},
+						Value:   ":8080",
+						Usage:   "address to serve /metrics, /healthz and /readyz on (empty to disable)",
+					},
+					&cli.DurationFlag{
+						Name:    "message-timeout",
+						EnvVars: []string{"MESSAGE_TIMEOUT"},
+						Value:   30 * time.Second,
+						Usage:   "how long a single message may take to be recorded before it is nacked (0 for no limit)",
+					},
+					&cli.IntFlag{
+						Name:    "max-delivery-attempts",
+						EnvVars: []string{"MAX_DELIVERY_ATTEMPTS"},
+						Usage:   "dead-letter messages which still fail on this delivery attempt instead of retrying them; needs a subscription with a dead letter policy, so Pubsub counts attempts (0 for no limit)",
+					},
+					&cli.StringFlag{
+						Name:    "change-topic",
+						EnvVars: []string{"PUBSUB_CHANGE_TOPIC_ID"},
+						Usage:   "what Pubsub topic to publish change events to, for the pubsub sink",
+					},
+					&cli.StringFlag{
+						Name:    "change-file",
+						EnvVars: []string{"CHANGE_FILE"},
+						Value:   "-",
+						Usage:   "NDJSON file to append change events to, for the file sink (- for stdout)",
+					},
+					&cli.IntFlag{
+						Name:    "breaker-failures",
+						EnvVars: []string{"BREAKER_FAILURE_THRESHOLD"},
+						Value:   5,
+						Usage:   "open the circuit breaker after this many consecutive failed database writes, pausing consumption (0 to never open it)",
+					},
+					&cli.DurationFlag{
+						Name:    "breaker-open-duration",
+						EnvVars: []string{"BREAKER_OPEN_DURATION"},
+						Value:   10 * time.Second,
+						Usage:   "how long the circuit breaker stays open before letting a write through to probe the database",
+					},
+					&cli.IntFlag{
+						Name:    "breaker-half-open-successes",
+						EnvVars: []string{"BREAKER_HALF_OPEN_SUCCESSES"},
+						Value:   1,
+						Usage:   "how many probing writes must succeed in a row to close the circuit breaker again",
+					},
+					&cli.IntFlag{
+						Name:    "max-outstanding-messages",
+						EnvVars: []string{"PUBSUB_MAX_OUTSTANDING_MESSAGES"},
+						Value:   1000,
+						Usage:   "most messages to have received but not yet acked or nacked (negative for no limit, except with --adaptive-flow)",
+					},
+					&cli.StringFlag{
+						Name:    "max-outstanding-bytes",
+						EnvVars: []string{"PUBSUB_MAX_OUTSTANDING_BYTES"},
+						Value:   "1GB",
+						Usage:   "most bytes of messages to have received but not yet acked or nacked, e.g. 64MiB",
+					},
+					&cli.IntFlag{
+						Name:    "num-goroutines",
+						EnvVars: []string{"PUBSUB_NUM_GOROUTINES"},
+						Value:   10,
+						Usage:   "how many streams to pull messages with",
+					},
+					&cli.DurationFlag{
+						Name:    "max-extension",
+						EnvVars: []string{"PUBSUB_MAX_EXTENSION"},
+						Value:   time.Hour,
+						Usage:   "how long to keep extending a message's ack deadline while it is processed",
+					},
+					&cli.DurationFlag{
+						Name:    "ack-deadline",
+						EnvVars: []string{"PUBSUB_ACK_DEADLINE"},
+						Usage:   "ack deadline to ask for on each extension, between 10s and 10m (if unset, picked from how long messages take to ack)",
+					},
+					&cli.BoolFlag{
+						Name:    "adaptive-flow",
+						EnvVars: []string{"ADAPTIVE_FLOW"},
+						Usage:   "adjust how many messages are processed at once to the database's write latency",
+					},
+					&cli.DurationFlag{
+						Name:    "target-latency",
+						EnvVars: []string{"ADAPTIVE_FLOW_TARGET_LATENCY"},
+						Value:   500 * time.Millisecond,
+						Usage:   "batch write latency for the adaptive flow control to aim for",
+					},
+					&cli.IntFlag{
+						Name:    "min-outstanding-messages",
+						EnvVars: []string{"ADAPTIVE_FLOW_MIN_OUTSTANDING_MESSAGES"},
+						Value:   10,
+						Usage:   "fewest messages the adaptive flow control lets through at once",
+					},
+				}, spoolFlags()...),
 			},
-			{
-				Name:   "schema",
-				Action: SchemaInitMain,
-			},
+			SchemaCommand(),
+			DeadLetterCommand(),
+			IngestCommand(),
+			APICommand(),
+			QueryCommand(),
+			ExportCommand(),
+			SpoolCommand(),
 		},
 	}
 }
 
 func ServerMain(cctx *cli.Context) error {
-	server, cleanup, err := initializeProcessor(
+	spoolConf, err := spoolConfiguration(cctx)
+	if err != nil {
+		return err
+	}
+
+	maxOutstandingBytes, err := parseSize(cctx.String("max-outstanding-bytes"))
+	if err != nil {
+		return fmt.Errorf("bad --max-outstanding-bytes: %w", err)
+	}
+
+	server, cleanup, err := initializeServer(
 		cctx.Context,
-		config.PostgresConfiguration{
-			Host:     cctx.String("pghost"),
-			Port:     cctx.Int("pgport"),
-			User:     cctx.String("pguser"),
-			Password: cctx.String("pgpass"),
-			Database: cctx.String("pgdb"),
+		postgresConfiguration(cctx),
+		loggingConfiguration(cctx),
+		config.PubsubConfiguration{
+			ProjectID:         cctx.String("project"),
+			SubscriptionID:    cctx.String("subscription"),
+			DeadLetterTopicID: cctx.String("dead-letter-topic"),
+
+			MaxOutstandingMessages: cctx.Int("max-outstanding-messages"),
+			MaxOutstandingBytes:    int(maxOutstandingBytes),
+			NumGoroutines:          cctx.Int("num-goroutines"),
+			MaxExtension:           cctx.Duration("max-extension"),
+			AckDeadline:            cctx.Duration("ack-deadline"),
+
+			AdaptiveFlow:           cctx.Bool("adaptive-flow"),
+			TargetLatency:          cctx.Duration("target-latency"),
+			MinOutstandingMessages: cctx.Int("min-outstanding-messages"),
 		},
-		config.LoggingConfiguration{
-			Debug:  cctx.Bool("debug"),
-			Pretty: cctx.Bool("pretty"),
+		batchConfiguration(cctx),
+		validationConfiguration(cctx),
+		config.MonitoringConfiguration{
+			Address: cctx.String("monitoring-address"),
 		},
-		config.PubsubConfiguration{
-			ProjectID:      cctx.String("project"),
-			SubscriptionID: cctx.String("subscription"),
+		config.ProcessorConfiguration{
+			MessageTimeout:      cctx.Duration("message-timeout"),
+			MaxDeliveryAttempts: cctx.Int("max-delivery-attempts"),
+		},
+		changesConfiguration(cctx),
+		spoolConf,
+		config.BreakerConfiguration{
+			FailureThreshold:  cctx.Int("breaker-failures"),
+			OpenDuration:      cctx.Duration("breaker-open-duration"),
+			HalfOpenSuccesses: cctx.Int("breaker-half-open-successes"),
 		},
 	)
 	if err != nil {
@@ -121,26 +289,43 @@ func ServerMain(cctx *cli.Context) error {
 	return err
 }
 
-func SchemaInitMain(cctx *cli.Context) error {
-	dao, cleanup, err := initializeSchemaDAO(
-		cctx.Context,
-		config.PostgresConfiguration{
-			Host:     cctx.String("pghost"),
-			Port:     cctx.Int("pgport"),
-			User:     cctx.String("pguser"),
-			Password: cctx.String("pgpass"),
-			Database: cctx.String("pgdb"),
-		},
-		config.LoggingConfiguration{
-			Debug:  cctx.Bool("debug"),
-			Pretty: cctx.Bool("pretty"),
-		},
-	)
-	if err != nil {
-		return err
+func postgresConfiguration(cctx *cli.Context) config.PostgresConfiguration {
+	return config.PostgresConfiguration{
+		Host:     cctx.String("pghost"),
+		Port:     cctx.Int("pgport"),
+		User:     cctx.String("pguser"),
+		Password: cctx.String("pgpass"),
+		Database: cctx.String("pgdb"),
 	}
-	err = dao.InitializeSchema()
-	cleanup()
-	return err
+}
+
+func loggingConfiguration(cctx *cli.Context) config.LoggingConfiguration {
+	return config.LoggingConfiguration{
+		Debug:  cctx.Bool("debug"),
+		Pretty: cctx.Bool("pretty"),
+	}
+}
 
+func batchConfiguration(cctx *cli.Context) config.BatchConfiguration {
+	return config.BatchConfiguration{
+		Size:       cctx.Int("batch-size"),
+		MaxLatency: cctx.Duration("batch-latency"),
+	}
+}
+
+// changesConfiguration reads the change sink; the topic and file are only flags of the server, which emits the events
+func changesConfiguration(cctx *cli.Context) config.ChangesConfiguration {
+	return config.ChangesConfiguration{
+		Sink:    cctx.String("change-sink"),
+		TopicID: cctx.String("change-topic"),
+		Path:    cctx.String("change-file"),
+	}
+}
+
+func validationConfiguration(cctx *cli.Context) config.ValidationConfiguration {
+	return config.ValidationConfiguration{
+		MaxClockSkew:    cctx.Duration("max-clock-skew"),
+		MaxAge:          cctx.Duration("max-scan-age"),
+		AllowedServices: cctx.StringSlice("allowed-services"),
+	}
 }
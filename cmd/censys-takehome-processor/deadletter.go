@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fsufitch/censys-takehome/database"
+	cli "github.com/urfave/cli/v2"
+)
+
+func DeadLetterCommand() *cli.Command {
+	filterFlags := []cli.Flag{
+		&cli.StringFlag{
+			Name:  "class",
+			Usage: "only dead letters with this error class (e.g. unmarshal, data, invalid)",
+		},
+		&cli.DurationFlag{
+			Name:  "older-than",
+			Usage: "only dead letters last seen at least this long ago",
+		},
+		&cli.IntFlag{
+			Name:  "limit",
+			Usage: "handle at most this many dead letters (0 for no limit)",
+		},
+	}
+
+	return &cli.Command{
+		Name:  "deadletter",
+		Usage: "inspect and reprocess messages which could not be decoded",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "list",
+				Usage:     "list dead letters",
+				ArgsUsage: "[id...]",
+				Flags:     filterFlags,
+				Action:    DeadLetterListMain,
+			},
+			{
+				Name:      "show",
+				Usage:     "show a single dead letter in full",
+				ArgsUsage: "<id>",
+				Action:    DeadLetterShowMain,
+			},
+			{
+				Name:      "replay",
+				Usage:     "decode dead letters again, recording the ones that now succeed",
+				ArgsUsage: "[id...]",
+				Flags:     filterFlags,
+				Action:    DeadLetterReplayMain,
+			},
+			{
+				Name:      "purge",
+				Usage:     "delete dead letters",
+				ArgsUsage: "[id...]",
+				Flags: append([]cli.Flag{
+					&cli.BoolFlag{
+						Name:  "all",
+						Usage: "allow purging without any filter or ids",
+					},
+				}, filterFlags...),
+				Action: DeadLetterPurgeMain,
+			},
+		},
+	}
+}
+
+func deadLetterFilter(cctx *cli.Context) (database.DeadLetterFilter, error) {
+	filter := database.DeadLetterFilter{
+		ErrorClass: cctx.String("class"),
+		Limit:      cctx.Int("limit"),
+	}
+	if olderThan := cctx.Duration("older-than"); olderThan > 0 {
+		filter.Before = time.Now().Add(-olderThan)
+	}
+	for _, arg := range cctx.Args().Slice() {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return filter, fmt.Errorf("invalid dead letter id %q: %w", arg, err)
+		}
+		filter.IDs = append(filter.IDs, id)
+	}
+	return filter, nil
+}
+
+func DeadLetterListMain(cctx *cli.Context) error {
+	filter, err := deadLetterFilter(cctx)
+	if err != nil {
+		return err
+	}
+
+	dao, cleanup, err := initializeDeadLetterDAO(cctx.Context, postgresConfiguration(cctx), loggingConfiguration(cctx))
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	deadLetters, err := dao.ListDeadLetters(cctx.Context, filter)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(cctx.App.Writer, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tMESSAGE ID\tCLASS\tSEEN\tFIRST SEEN\tLAST SEEN\tERROR")
+	for _, dl := range deadLetters {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			dl.ID, dl.MessageID, dl.ErrorClass, dl.TimesSeen,
+			dl.FirstSeen.Format(time.RFC3339), dl.LastSeen.Format(time.RFC3339), dl.Error)
+	}
+	return w.Flush()
+}
+
+func DeadLetterShowMain(cctx *cli.Context) error {
+	if cctx.NArg() != 1 {
+		return errors.New("expected exactly one dead letter id")
+	}
+	id, err := strconv.ParseInt(cctx.Args().First(), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid dead letter id %q: %w", cctx.Args().First(), err)
+	}
+
+	dao, cleanup, err := initializeDeadLetterDAO(cctx.Context, postgresConfiguration(cctx), loggingConfiguration(cctx))
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	dl, err := dao.GetDeadLetter(cctx.Context, id)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(cctx.App.Writer, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%d\n", dl.ID)
+	fmt.Fprintf(w, "Message ID:\t%s\n", dl.MessageID)
+	fmt.Fprintf(w, "Error class:\t%s\n", dl.ErrorClass)
+	fmt.Fprintf(w, "Error:\t%s\n", dl.Error)
+	fmt.Fprintf(w, "Times seen:\t%d\n", dl.TimesSeen)
+	fmt.Fprintf(w, "First seen:\t%s\n", dl.FirstSeen.Format(time.RFC3339))
+	fmt.Fprintf(w, "Last seen:\t%s\n", dl.LastSeen.Format(time.RFC3339))
+
+	keys := make([]string, 0, len(dl.Attributes))
+	for k := range dl.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "Attribute %s:\t%s\n", k, dl.Attributes[k])
+	}
+
+	fmt.Fprintf(w, "Data:\t%q\n", dl.Data)
+	return w.Flush()
+}
+
+func DeadLetterReplayMain(cctx *cli.Context) error {
+	filter, err := deadLetterFilter(cctx)
+	if err != nil {
+		return err
+	}
+
+	replayer, cleanup, err := initializeReplayer(cctx.Context, postgresConfiguration(cctx), loggingConfiguration(cctx), batchConfiguration(cctx), validationConfiguration(cctx), changesConfiguration(cctx))
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	summary, err := replayer.Replay(filter)
+	fmt.Fprintf(cctx.App.Writer, "recorded: %d, stale: %d, dropped: %d, still failing: %d\n", summary.Recorded, summary.Stale, summary.Dropped, summary.Failed)
+	return err
+}
+
+func DeadLetterPurgeMain(cctx *cli.Context) error {
+	filter, err := deadLetterFilter(cctx)
+	if err != nil {
+		return err
+	}
+	if len(filter.IDs) == 0 && filter.ErrorClass == "" && filter.Before.IsZero() && !cctx.Bool("all") {
+		return errors.New("refusing to purge every dead letter without --all")
+	}
+
+	dao, cleanup, err := initializeDeadLetterDAO(cctx.Context, postgresConfiguration(cctx), loggingConfiguration(cctx))
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	deleted, err := dao.PurgeDeadLetters(cctx.Context, filter)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cctx.App.Writer, "purged: %d\n", deleted)
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/fsufitch/censys-takehome/export"
+	cli "github.com/urfave/cli/v2"
+)
+
+func ExportCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "export",
+		Usage:     "write a snapshot of the scan entries to NDJSON, CSV or Parquet files, with a manifest",
+		ArgsUsage: "[search query]",
+		Description: entryFilterDescription + "\n" +
+			"With --as-of, the entries are rebuilt from the history as they were at that time.",
+		Flags: append(entryFilterFlags(),
+			&cli.StringFlag{
+				Name:     "dir",
+				Aliases:  []string{"o"},
+				Required: true,
+				Usage:    "directory to write the files and manifest to",
+			},
+			&cli.StringFlag{
+				Name:  "prefix",
+				Value: "scan_entries",
+				Usage: "start of the file names",
+			},
+			&cli.StringFlag{
+				Name:    "format",
+				Aliases: []string{"f"},
+				Value:   export.Format_NDJSON,
+				Usage:   "output format: ndjson, csv or parquet",
+			},
+			&cli.StringFlag{
+				Name:  "compression",
+				Value: export.Compression_Gzip,
+				Usage: "compression: none, gzip or zstd",
+			},
+			&cli.StringFlag{
+				Name:  "max-file-size",
+				Value: "256MiB",
+				Usage: "start a new file once one reaches about this size, e.g. 64MiB or 1GB (0 for a single file)",
+			},
+			&cli.StringFlag{
+				Name:  "as-of",
+				Usage: "export the entries as they were at this time, according to the history",
+			},
+		),
+		Action: ExportMain,
+	}
+}
+
+// parseSize reads a number of bytes, with an optional (decimal or binary) unit
+func parseSize(s string) (int64, error) {
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9},
+		{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30},
+		{"B", 1},
+	}
+	s = strings.TrimSpace(s)
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(strings.ToUpper(s), strings.ToUpper(unit.suffix)) {
+			s, multiplier = strings.TrimSpace(s[:len(s)-len(unit.suffix)]), unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+func ExportMain(cctx *cli.Context) error {
+	q, err := entryQuery(cctx)
+	if err != nil {
+		return err
+	}
+	if s := cctx.String("as-of"); s != "" {
+		if q.AsOf, err = parseTimeFlag("as-of", s); err != nil {
+			return err
+		}
+	}
+	maxFileBytes, err := parseSize(cctx.String("max-file-size"))
+	if err != nil {
+		return fmt.Errorf("invalid --max-file-size: %w", err)
+	}
+
+	exporter, cleanup, err := initializeExporter(cctx.Context, postgresConfiguration(cctx), loggingConfiguration(cctx))
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	manifest, err := exporter.Run(export.Options{
+		Dir:          cctx.String("dir"),
+		Prefix:       cctx.String("prefix"),
+		Format:       strings.ToLower(cctx.String("format")),
+		Compression:  strings.ToLower(cctx.String("compression")),
+		MaxFileBytes: maxFileBytes,
+		Query:        q,
+	})
+	fmt.Fprintf(cctx.App.Writer, "rows: %d, files: %d\n", manifest.Rows, len(manifest.Files))
+	return err
+}
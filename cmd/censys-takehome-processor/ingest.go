@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/fsufitch/censys-takehome/processor"
+	cli "github.com/urfave/cli/v2"
+)
+
+func IngestCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "ingest",
+		Usage:     "record newline-delimited JSON scans (plain or gzipped) from files or stdin",
+		ArgsUsage: "[file|glob|-]...",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "checkpoint",
+				Usage: "file to keep track of progress in; rerunning with the same file resumes where the last run stopped (not for stdin)",
+			},
+			&cli.DurationFlag{
+				Name:  "progress",
+				Usage: "how often to log progress (0 to disable)",
+				Value: 5 * time.Second,
+			},
+		},
+		Action: IngestMain,
+	}
+}
+
+func IngestMain(cctx *cli.Context) error {
+	names, err := processor.ExpandInputs(cctx.Args().Slice())
+	if err != nil {
+		return err
+	}
+
+	if cctx.String("checkpoint") != "" && slices.Contains(names, processor.StdinName) {
+		// Another run's stdin is another stream, so its offset would skip unrelated data
+		return errors.New("--checkpoint can't be used when reading stdin")
+	}
+
+	checkpoint, err := processor.LoadIngestCheckpoint(cctx.String("checkpoint"))
+	if err != nil {
+		return err
+	}
+
+	ingester, cleanup, err := initializeIngester(cctx.Context, postgresConfiguration(cctx), loggingConfiguration(cctx), batchConfiguration(cctx), validationConfiguration(cctx), changesConfiguration(cctx))
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	summary, err := ingester.Ingest(names, checkpoint, cctx.Duration("progress"))
+	fmt.Fprintf(cctx.App.Writer, "files: %d, records: %d, accepted: %d, stale: %d, rejected: %d, dropped: %d\n",
+		summary.Files, summary.Records, summary.Accepted, summary.Stale, summary.Rejected, summary.Dropped)
+	return err
+}
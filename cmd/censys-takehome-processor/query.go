@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fsufitch/censys-takehome/api"
+	"github.com/fsufitch/censys-takehome/database"
+	"github.com/fsufitch/censys-takehome/export"
+	"github.com/fsufitch/censys-takehome/search"
+	cli "github.com/urfave/cli/v2"
+)
+
+// queryPageSize is how many entries are read from the database at a time
+const queryPageSize = 1000
+
+// tableDataWidth is how much of each response the table shows
+const tableDataWidth = 60
+
+// entryFilterDescription explains the filters of commands using entryFilterFlags
+const entryFilterDescription = "Filters may be combined with each other, and with a search query such as\n" +
+	"   service:SSH and port:22 and ip:1.1.1.0/24 and data:\"OpenSSH_8\" and updated>2024-12-01\n" +
+	"Times are RFC 3339 timestamps, dates (2006-01-02), Unix seconds, or durations ago (e.g. 24h)."
+
+// entryFilterFlags are the flags read by entryQuery
+func entryFilterFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{Name: "ip", Usage: "only this host"},
+		&cli.StringFlag{Name: "cidr", Usage: "only hosts within this network, e.g. 1.1.1.0/24"},
+		&cli.UintFlag{Name: "port", Usage: "only this port"},
+		&cli.StringFlag{Name: "service", Usage: "only this service name (exact)"},
+		&cli.StringFlag{Name: "since", Usage: "only entries updated at or after this time"},
+		&cli.StringFlag{Name: "until", Usage: "only entries updated before this time"},
+		&cli.StringFlag{Name: "text", Usage: "only entries whose response contains these words (web search syntax, using the full-text index)"},
+	}
+}
+
+func QueryCommand() *cli.Command {
+	return &cli.Command{
+		Name:        "query",
+		Usage:       "look up recorded scan entries",
+		ArgsUsage:   "[search query]",
+		Description: entryFilterDescription,
+		Flags: append(entryFilterFlags(),
+			&cli.StringFlag{
+				Name:    "format",
+				Aliases: []string{"f"},
+				Value:   "table",
+				Usage:   "output format: table, json, ndjson or csv",
+			},
+			&cli.IntFlag{
+				Name:  "limit",
+				Value: 100,
+				Usage: "print at most this many entries (0 for no limit)",
+			},
+			&cli.StringFlag{
+				Name:  "sort",
+				Value: "key",
+				Usage: "order by key (ip, port, service) or updated; prefix with - for descending, e.g. -updated",
+			},
+			&cli.BoolFlag{
+				Name:  "count",
+				Usage: "only print how many entries match",
+			},
+		),
+		Action: QueryMain,
+	}
+}
+
+// parseTimeFlag reads a time the way the query command's help describes
+func parseTimeFlag(name string, s string) (time.Time, error) {
+	if unix, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.Local(), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid --%s %q: expected an RFC 3339 timestamp, date, Unix seconds or duration", name, s)
+}
+
+// entryQuery builds the query described by the filter flags and arguments
+func entryQuery(cctx *cli.Context) (database.EntryQuery, error) {
+	q := database.EntryQuery{
+		Port:    uint32(cctx.Uint("port")),
+		Service: cctx.String("service"),
+		Text:    cctx.String("text"),
+	}
+
+	if s := cctx.String("ip"); s != "" {
+		if q.IP = net.ParseIP(s); q.IP == nil {
+			return q, fmt.Errorf("invalid --ip %q", s)
+		}
+	}
+	if s := cctx.String("cidr"); s != "" {
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return q, fmt.Errorf("invalid --cidr %q: %w", s, err)
+		}
+		q.CIDR = network
+	}
+	for name, t := range map[string]*time.Time{"since": &q.UpdatedSince, "until": &q.UpdatedUntil} {
+		if s := cctx.String(name); s != "" {
+			parsed, err := parseTimeFlag(name, s)
+			if err != nil {
+				return q, err
+			}
+			*t = parsed
+		}
+	}
+
+	if cctx.NArg() > 0 {
+		parsed, err := search.Parse(strings.Join(cctx.Args().Slice(), " "))
+		if syntaxErr := (search.SyntaxError{}); errors.As(err, &syntaxErr) {
+			return q, fmt.Errorf("%w\n%s", err, syntaxErr.Caret())
+		} else if err != nil {
+			return q, err
+		}
+		q.Condition = parsed
+	}
+
+	sort := cctx.String("sort")
+	q.Descending = strings.HasPrefix(sort, "-")
+	var err error
+	if q.Sort, err = database.ParseEntrySort(strings.TrimPrefix(sort, "-")); err != nil {
+		return q, fmt.Errorf("invalid --sort %q: expected key or updated", sort)
+	}
+	return q, nil
+}
+
+func QueryMain(cctx *cli.Context) error {
+	q, err := entryQuery(cctx)
+	if err != nil {
+		return err
+	}
+	out, err := newEntryWriter(cctx.String("format"), cctx.App.Writer)
+	if err != nil {
+		return err
+	}
+
+	dao, cleanup, err := initializeScanEntryDAO(cctx.Context, postgresConfiguration(cctx), loggingConfiguration(cctx))
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if cctx.Bool("count") {
+		count, err := dao.CountEntries(cctx.Context, q)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(cctx.App.Writer, count)
+		return nil
+	}
+
+	// Page through the results, so that unlimited queries don't have to fit in memory
+	remaining := cctx.Int("limit")
+	for {
+		q.Limit = queryPageSize
+		if remaining > 0 && remaining < q.Limit {
+			q.Limit = remaining
+		}
+
+		page, err := dao.ListEntries(cctx.Context, q)
+		if err != nil {
+			return err
+		}
+		for _, e := range page.Entries {
+			if err := out.Write(e); err != nil {
+				return err
+			}
+		}
+
+		if remaining > 0 {
+			remaining -= len(page.Entries)
+			if remaining == 0 {
+				break
+			}
+		}
+		if page.Next == nil {
+			break
+		}
+		q.After = page.Next
+	}
+	return out.Close()
+}
+
+// entryWriter prints entries in one of the query command's output formats
+type entryWriter interface {
+	Write(database.ScanEntry) error
+	Close() error
+}
+
+func newEntryWriter(format string, w io.Writer) (entryWriter, error) {
+	switch strings.ToLower(format) {
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "IP\tPORT\tSERVICE\tUPDATED\tLAST CHANGED\tSEEN\tDATA")
+		return tableEntryWriter{tw}, nil
+	case "json":
+		return &jsonEntryWriter{w: w}, nil
+	case "ndjson":
+		return ndjsonEntryWriter{json.NewEncoder(w)}, nil
+	case "csv":
+		cw := csv.NewWriter(w)
+		return csvEntryWriter{cw}, cw.Write(export.CSVHeader)
+	default:
+		return nil, fmt.Errorf("unknown format %q: expected table, json, ndjson or csv", format)
+	}
+}
+
+type tableEntryWriter struct{ tw *tabwriter.Writer }
+
+func (t tableEntryWriter) Write(e database.ScanEntry) error {
+	data := strconv.Quote(e.Data)
+	if runes := []rune(data); len(runes) > tableDataWidth {
+		data = string(runes[:tableDataWidth-1]) + "…"
+	}
+	_, err := fmt.Fprintf(t.tw, "%s\t%d\t%s\t%s\t%s\t%d\t%s\n",
+		e.IP, e.Port, e.Service, e.Updated.Format(time.RFC3339), e.LastChanged.Format(time.RFC3339), e.TimesSeen, data)
+	return err
+}
+
+func (t tableEntryWriter) Close() error { return t.tw.Flush() }
+
+// jsonEntryWriter prints a single JSON array, element by element
+type jsonEntryWriter struct {
+	w       io.Writer
+	started bool
+}
+
+func (j *jsonEntryWriter) Write(e database.ScanEntry) error {
+	sep := ",\n  "
+	if !j.started {
+		sep = "[\n  "
+		j.started = true
+	}
+	data, err := json.Marshal(api.NewEntry(e))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(j.w, "%s%s", sep, data)
+	return err
+}
+
+func (j *jsonEntryWriter) Close() error {
+	if !j.started {
+		_, err := fmt.Fprintln(j.w, "[]")
+		return err
+	}
+	_, err := fmt.Fprintln(j.w, "\n]")
+	return err
+}
+
+type ndjsonEntryWriter struct{ enc *json.Encoder }
+
+func (n ndjsonEntryWriter) Write(e database.ScanEntry) error { return n.enc.Encode(api.NewEntry(e)) }
+func (n ndjsonEntryWriter) Close() error                     { return nil }
+
+// csvEntryWriter prints the same columns as CSV exports
+type csvEntryWriter struct{ cw *csv.Writer }
+
+func (c csvEntryWriter) Write(e database.ScanEntry) error {
+	return c.cw.Write(export.NewRow(e).CSVRecord())
+}
+
+func (c csvEntryWriter) Close() error {
+	c.cw.Flush()
+	return c.cw.Error()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fsufitch/censys-takehome/database"
+	cli "github.com/urfave/cli/v2"
+)
+
+func SchemaCommand() *cli.Command {
+	return &cli.Command{
+		Name:   "schema",
+		Usage:  "manage the database schema; without a subcommand, applies all pending migrations",
+		Action: SchemaInitMain,
+		Subcommands: []*cli.Command{
+			{
+				Name:   "up",
+				Usage:  "apply all pending migrations",
+				Action: SchemaInitMain,
+			},
+			{
+				Name:  "down",
+				Usage: "roll back the most recent migrations",
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:  "steps",
+						Usage: "how many migrations to roll back",
+						Value: 1,
+					},
+				},
+				Action: SchemaDownMain,
+			},
+			{
+				Name:      "to",
+				Usage:     "apply or roll back migrations until the schema is at the given version (0 for none)",
+				ArgsUsage: "<version>",
+				Action:    SchemaToMain,
+			},
+			{
+				Name:   "status",
+				Usage:  "list migrations and whether they are applied",
+				Action: SchemaStatusMain,
+			},
+		},
+	}
+}
+
+func SchemaInitMain(cctx *cli.Context) error {
+	dao, cleanup, err := initializeSchemaDAO(
+		cctx.Context,
+		postgresConfiguration(cctx),
+		loggingConfiguration(cctx),
+	)
+	if err != nil {
+		return err
+	}
+	err = dao.InitializeSchema(cctx.Context)
+	cleanup()
+	return err
+}
+
+func SchemaDownMain(cctx *cli.Context) error {
+	dao, cleanup, err := initializeSchemaDAO(cctx.Context, postgresConfiguration(cctx), loggingConfiguration(cctx))
+	if err != nil {
+		return err
+	}
+	err = dao.MigrateDown(cctx.Context, cctx.Int("steps"))
+	cleanup()
+	return err
+}
+
+func SchemaToMain(cctx *cli.Context) error {
+	if cctx.NArg() != 1 {
+		return errors.New("expected exactly one version")
+	}
+	version, err := strconv.Atoi(cctx.Args().First())
+	if err != nil {
+		return fmt.Errorf("invalid version %q: %w", cctx.Args().First(), err)
+	}
+
+	dao, cleanup, err := initializeSchemaDAO(cctx.Context, postgresConfiguration(cctx), loggingConfiguration(cctx))
+	if err != nil {
+		return err
+	}
+	err = dao.MigrateTo(cctx.Context, version)
+	cleanup()
+	return err
+}
+
+func SchemaStatusMain(cctx *cli.Context) error {
+	dao, cleanup, err := initializeSchemaDAO(cctx.Context, postgresConfiguration(cctx), loggingConfiguration(cctx))
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	statuses, err := dao.Status(cctx.Context)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(cctx.App.Writer, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tSTATUS\tAPPLIED AT")
+	for _, st := range statuses {
+		appliedAt := ""
+		if st.Applied {
+			appliedAt = st.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", st.Version, st.Name, migrationState(st), appliedAt)
+	}
+	return w.Flush()
+}
+
+func migrationState(st database.MigrationStatus) string {
+	switch {
+	case st.Unknown:
+		return "applied (unknown to this build)"
+	case st.ChecksumMismatch:
+		return "applied (checksum mismatch)"
+	case st.Applied:
+		return "applied"
+	default:
+		return "pending"
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"github.com/fsufitch/censys-takehome/monitoring"
+	"github.com/fsufitch/censys-takehome/processor"
+)
+
+// ProcessorServer is everything the "server" command runs side by side
+type ProcessorServer struct {
+	Processor  processor.Processor
+	Monitoring *monitoring.Server
+}
+
+func (srv ProcessorServer) Run() error {
+	go func() {
+		if err := srv.Monitoring.Run(); err != nil {
+			srv.Monitoring.Log().Err(err).Msg("monitoring server failed")
+		}
+	}()
+
+	return srv.Processor.Run()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fsufitch/censys-takehome/config"
+	"github.com/fsufitch/censys-takehome/database"
+	"github.com/fsufitch/censys-takehome/spool"
+	cli "github.com/urfave/cli/v2"
+)
+
+// spoolFlags configure the spool; they are shared by the server and the spool command
+func spoolFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "spool-dir",
+			EnvVars: []string{"SPOOL_DIR"},
+			Usage:   "directory to spool entries to while the database is unavailable (if unset, they are nacked instead)",
+		},
+		&cli.StringFlag{
+			Name:    "spool-max-size",
+			EnvVars: []string{"SPOOL_MAX_SIZE"},
+			Value:   "1GiB",
+			Usage:   "most disk space the spool may take up, e.g. 512MiB (0 for no limit); once full, entries are nacked",
+		},
+		&cli.StringFlag{
+			Name:    "spool-segment-size",
+			EnvVars: []string{"SPOOL_SEGMENT_SIZE"},
+			Value:   "16MiB",
+			Usage:   "start a new spool segment file once one reaches about this size",
+		},
+		&cli.DurationFlag{
+			Name:    "spool-drain-interval",
+			EnvVars: []string{"SPOOL_DRAIN_INTERVAL"},
+			Value:   5 * time.Second,
+			Usage:   "how often to check whether spooled entries can be written to the database",
+		},
+	}
+}
+
+func spoolConfiguration(cctx *cli.Context) (config.SpoolConfiguration, error) {
+	maxBytes, err := parseSize(cctx.String("spool-max-size"))
+	if err != nil {
+		return config.SpoolConfiguration{}, fmt.Errorf("bad --spool-max-size: %w", err)
+	}
+	segmentBytes, err := parseSize(cctx.String("spool-segment-size"))
+	if err != nil {
+		return config.SpoolConfiguration{}, fmt.Errorf("bad --spool-segment-size: %w", err)
+	}
+	return config.SpoolConfiguration{
+		Dir:           cctx.String("spool-dir"),
+		SegmentBytes:  segmentBytes,
+		MaxBytes:      maxBytes,
+		DrainInterval: cctx.Duration("spool-drain-interval"),
+	}, nil
+}
+
+func SpoolCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "spool",
+		Usage: "look at and write out entries spooled to disk while the database was unavailable",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "inspect",
+				Usage: "list the spool's segments (works while a server is using the spool)",
+				Flags: append(spoolFlags(),
+					&cli.BoolFlag{
+						Name:  "entries",
+						Usage: "list every spooled entry too",
+					},
+				),
+				Action: SpoolInspectMain,
+			},
+			{
+				Name:   "drain",
+				Usage:  "write every spooled entry to the database (the server must not be using the spool)",
+				Flags:  spoolFlags(),
+				Action: SpoolDrainMain,
+			},
+		},
+	}
+}
+
+func SpoolInspectMain(cctx *cli.Context) error {
+	dir := cctx.String("spool-dir")
+	if dir == "" {
+		return errors.New("no --spool-dir given")
+	}
+
+	w := tabwriter.NewWriter(cctx.App.Writer, 0, 4, 2, ' ', 0)
+	var onEntry func(*spool.Segment, database.ScanEntry) error
+	if cctx.Bool("entries") {
+		fmt.Fprintln(w, "SEGMENT\tIP\tPORT\tSERVICE\tUPDATED\tMESSAGE ID")
+		onEntry = func(seg *spool.Segment, e database.ScanEntry) error {
+			_, err := fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\t%s\n", seg.Seq, e.IP, e.Port, e.Service, e.Updated.Format(time.RFC3339), e.MessageID)
+			return err
+		}
+	}
+
+	segments, err := spool.Inspect(dir, onEntry)
+	if err != nil {
+		return err
+	}
+	if onEntry != nil {
+		fmt.Fprintln(w)
+	}
+
+	entries, size := 0, int64(0)
+	fmt.Fprintln(w, "SEGMENT\tENTRIES\tBYTES\tSTATUS")
+	for _, seg := range segments {
+		status := "ok"
+		if seg.Problem != nil {
+			status = seg.Problem.Error()
+		}
+		fmt.Fprintf(w, "%d\t%d\t%d\t%s\n", seg.Seq, seg.Entries, seg.Bytes, status)
+		entries += seg.Entries
+		size += seg.Bytes
+	}
+	fmt.Fprintf(w, "total\t%d\t%d\t\n", entries, size)
+	return w.Flush()
+}
+
+func SpoolDrainMain(cctx *cli.Context) error {
+	conf, err := spoolConfiguration(cctx)
+	if err != nil {
+		return err
+	}
+	if conf.Dir == "" {
+		return errors.New("no --spool-dir given")
+	}
+
+	drainer, cleanup, err := initializeSpoolDrainer(cctx.Context, postgresConfiguration(cctx), loggingConfiguration(cctx), batchConfiguration(cctx), conf, changesConfiguration(cctx))
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	summary, err := drainer.Drain()
+	drainer.Log().Info().Int("drained", summary.Entries).Int("accepted", summary.Accepted).Int("stale", summary.Stale).Int("deadLettered", summary.DeadLettered).Msg("drain done")
+	return err
+}
@@ -8,24 +8,95 @@ package main
 import (
 	"context"
 
+	"github.com/fsufitch/censys-takehome/api"
 	"github.com/fsufitch/censys-takehome/config"
 	"github.com/fsufitch/censys-takehome/database"
+	"github.com/fsufitch/censys-takehome/export"
 	"github.com/fsufitch/censys-takehome/logging"
+	"github.com/fsufitch/censys-takehome/messaging"
+	"github.com/fsufitch/censys-takehome/monitoring"
 	"github.com/fsufitch/censys-takehome/processor"
+	"github.com/fsufitch/censys-takehome/validation"
 	"github.com/google/wire"
 )
 
-func initializeProcessor(context.Context, config.PostgresConfiguration, config.LoggingConfiguration, config.PubsubConfiguration) (processor.Processor, func(), error) {
+func initializeServer(context.Context, config.PostgresConfiguration, config.LoggingConfiguration, config.PubsubConfiguration, config.BatchConfiguration, config.ValidationConfiguration, config.MonitoringConfiguration, config.ProcessorConfiguration, config.ChangesConfiguration, config.SpoolConfiguration, config.BreakerConfiguration) (ProcessorServer, func(), error) {
 	panic(wire.Build(
+		wire.Struct(new(ProcessorServer), "*"),
 		processor.ProvideProcessor,
+		monitoring.ProvideMonitoring,
 		logging.ProvideLogFunc,
-		database.ProvideScanEntryDAO,
+		database.ProvideDatabase,
+		messaging.ProvidePubsubSource,
+		validation.ProvideValidator,
 	))
 }
 
 func initializeSchemaDAO(context.Context, config.PostgresConfiguration, config.LoggingConfiguration) (database.SchemaDAO, func(), error) {
 	panic(wire.Build(
-		database.ProvideSchemaDAO,
+		database.ProvideDatabase,
+		logging.ProvideLogFunc,
+	))
+}
+
+// readOnly stands in for the change configuration of commands which never write entries, so never record changes
+var readOnly = wire.Value(config.ChangesConfiguration{})
+
+func initializeScanEntryDAO(context.Context, config.PostgresConfiguration, config.LoggingConfiguration) (*database.ScanEntryDAO, func(), error) {
+	panic(wire.Build(
+		readOnly,
+		database.ProvideDatabase,
+		logging.ProvideLogFunc,
+	))
+}
+
+func initializeDeadLetterDAO(context.Context, config.PostgresConfiguration, config.LoggingConfiguration) (*database.DeadLetterDAO, func(), error) {
+	panic(wire.Build(
+		database.ProvideDatabase,
+		logging.ProvideLogFunc,
+	))
+}
+
+func initializeReplayer(context.Context, config.PostgresConfiguration, config.LoggingConfiguration, config.BatchConfiguration, config.ValidationConfiguration, config.ChangesConfiguration) (processor.Replayer, func(), error) {
+	panic(wire.Build(
+		processor.ProvideReplayer,
+		database.ProvideDatabase,
+		logging.ProvideLogFunc,
+		validation.ProvideValidator,
+	))
+}
+
+func initializeIngester(context.Context, config.PostgresConfiguration, config.LoggingConfiguration, config.BatchConfiguration, config.ValidationConfiguration, config.ChangesConfiguration) (processor.Ingester, func(), error) {
+	panic(wire.Build(
+		processor.ProvideIngester,
+		database.ProvideDatabase,
+		logging.ProvideLogFunc,
+		validation.ProvideValidator,
+	))
+}
+
+func initializeAPI(context.Context, config.PostgresConfiguration, config.LoggingConfiguration, config.APIConfiguration) (*api.Server, func(), error) {
+	panic(wire.Build(
+		readOnly,
+		api.ProvideAPI,
+		database.ProvideDatabase,
+		logging.ProvideLogFunc,
+	))
+}
+
+func initializeExporter(context.Context, config.PostgresConfiguration, config.LoggingConfiguration) (export.Exporter, func(), error) {
+	panic(wire.Build(
+		readOnly,
+		export.ProvideExporter,
+		database.ProvideDatabase,
+		logging.ProvideLogFunc,
+	))
+}
+
+func initializeSpoolDrainer(context.Context, config.PostgresConfiguration, config.LoggingConfiguration, config.BatchConfiguration, config.SpoolConfiguration, config.ChangesConfiguration) (processor.SpoolDrainer, func(), error) {
+	panic(wire.Build(
+		processor.ProvideSpoolDrainer,
+		database.ProvideDatabase,
 		logging.ProvideLogFunc,
 	))
 }
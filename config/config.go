@@ -1,5 +1,7 @@
 package config
 
+import "time"
+
 type LoggingConfiguration struct {
 	Debug  bool
 	Pretty bool
@@ -14,6 +16,63 @@ type PostgresConfiguration struct {
 }
 
 type PubsubConfiguration struct {
-	ProjectID      string
-	SubscriptionID string
+	ProjectID         string
+	SubscriptionID    string
+	DeadLetterTopicID string // Optional; if empty, dead letters are only kept in the database
+
+	// Receive settings; zero values leave the library defaults
+	MaxOutstandingMessages int           // Most messages received but not yet acked or nacked
+	MaxOutstandingBytes    int           // Most bytes of messages received but not yet acked or nacked
+	NumGoroutines          int           // Number of streams pulling messages
+	MaxExtension           time.Duration // How long to keep extending a message's ack deadline while it is processed
+	AckDeadline            time.Duration // Ack deadline to ask for on each extension (10s to 10m); 0 to let the library pick
+
+	AdaptiveFlow           bool          // Whether to adjust how many messages are processed at once to the database's latency
+	TargetLatency          time.Duration // Batch write latency the adaptive flow control aims for
+	MinOutstandingMessages int           // Fewest messages the adaptive flow control lets through at once
+}
+
+type BatchConfiguration struct {
+	Size       int           // Flush once this many entries are pending
+	MaxLatency time.Duration // Flush once the oldest pending entry has waited this long
+}
+
+type ValidationConfiguration struct {
+	MaxClockSkew    time.Duration // How far in the future scan timestamps may be
+	MaxAge          time.Duration // How far in the past scan timestamps may be; 0 for no limit
+	AllowedServices []string      // Empty to allow any service name
+}
+
+type MonitoringConfiguration struct {
+	Address string // Where to serve metrics and health endpoints, e.g. ":8080"; empty to disable
+}
+
+type ChangesConfiguration struct {
+	Sink    string // Where to emit change events: "postgres", "pubsub", "file", or empty to not emit them
+	TopicID string // Pubsub topic for the "pubsub" sink
+	Path    string // NDJSON file for the "file" sink, appended to; "-" for stdout
+}
+
+type APIConfiguration struct {
+	Address     string // Where to serve the API, e.g. ":8081"
+	PageSize    int    // Entries per page, unless a request asks for fewer or more
+	MaxPageSize int    // Most entries a request may ask for per page
+}
+
+type ProcessorConfiguration struct {
+	MessageTimeout      time.Duration // How long a single message may take to process before it is nacked; 0 for no limit
+	MaxDeliveryAttempts int           // Dead-letter messages which still fail on this delivery attempt, rather than retry them; 0 for no limit
+}
+
+type SpoolConfiguration struct {
+	Dir           string        // Where to keep entries while the database is unavailable; empty to disable spooling
+	SegmentBytes  int64         // Start a new segment file once the current one would grow past this size
+	MaxBytes      int64         // Refuse to spool more once the segments add up to this size; 0 for no limit
+	DrainInterval time.Duration // How often to check whether spooled entries can be written to the database
+}
+
+type BreakerConfiguration struct {
+	FailureThreshold  int           // Open after this many consecutive failed database writes; 0 to never open
+	OpenDuration      time.Duration // How long to stay open before probing the database again
+	HalfOpenSuccesses int           // Close after this many consecutive successful probes
 }
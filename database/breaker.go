@@ -0,0 +1,189 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fsufitch/censys-takehome/config"
+	"github.com/fsufitch/censys-takehome/logging"
+)
+
+// ErrCircuitOpen is returned instead of calling the database while the circuit breaker is open.
+// It is a connection error, since that is what the breaker stands in for.
+var ErrCircuitOpen = fmt.Errorf("%w: circuit breaker open", ErrConnection)
+
+type BreakerState int
+
+const (
+	BreakerState_Closed   BreakerState = iota // Calls go through
+	BreakerState_HalfOpen                     // Calls go through one at a time, to probe whether the database is back
+	BreakerState_Open                         // Calls fail right away
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerState_Closed:
+		return "closed"
+	case BreakerState_HalfOpen:
+		return "half-open"
+	case BreakerState_Open:
+		return "open"
+	default:
+		return "undefined"
+	}
+}
+
+// CircuitBreaker stops calls to the database after too many consecutive failures, and lets them through again
+// once probing calls succeed
+type CircuitBreaker struct {
+	Config config.BreakerConfiguration
+	Log    logging.LogFunc
+
+	mu        sync.Mutex
+	state     BreakerState
+	failures  int           // Consecutive failures while closed
+	successes int           // Consecutive successful probes while half-open
+	probing   bool          // Whether a probe is in flight while half-open
+	openedAt  time.Time     // When the breaker last opened
+	lastErr   error         // The failure which last opened the breaker
+	changed   chan struct{} // Closed (and replaced) whenever the state changes
+}
+
+func ProvideCircuitBreaker(conf config.BreakerConfiguration, logFunc logging.LogFunc) *CircuitBreaker {
+	if conf.HalfOpenSuccesses < 1 {
+		conf.HalfOpenSuccesses = 1
+	}
+	return &CircuitBreaker{
+		Config:  conf,
+		Log:     logFunc,
+		changed: make(chan struct{}),
+	}
+}
+
+// State reports what state the breaker is in
+func (cb *CircuitBreaker) State() BreakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.refresh()
+	return cb.state
+}
+
+// Do calls fn unless the breaker is open (or half-open and already probing), recording whether it failed.
+// Errors from canceled contexts and permanent errors (which say nothing about the database's health) are passed
+// on, but count neither way.
+func (cb *CircuitBreaker) Do(fn func() error) error {
+	if err := cb.acquire(); err != nil {
+		return err
+	}
+	err := fn()
+	cb.record(err)
+	return err
+}
+
+// Wait blocks while the breaker is open, until it may let calls through again or the context is done
+func (cb *CircuitBreaker) Wait(ctx context.Context) error {
+	for {
+		cb.mu.Lock()
+		cb.refresh()
+		if cb.state != BreakerState_Open {
+			cb.mu.Unlock()
+			return nil
+		}
+		remaining := time.Until(cb.openedAt.Add(cb.Config.OpenDuration))
+		changed := cb.changed
+		cb.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: gave up waiting for the circuit breaker: %w", ErrConnection, ctx.Err())
+		case <-changed:
+		case <-time.After(remaining):
+		}
+	}
+}
+
+// Check is a readiness check, failing while the breaker is open
+func (cb *CircuitBreaker) Check(context.Context) error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.refresh()
+	if cb.state != BreakerState_Open {
+		return nil
+	}
+	return fmt.Errorf("%w since %s, retrying at %s: %w", ErrCircuitOpen,
+		cb.openedAt.Format(time.RFC3339), cb.openedAt.Add(cb.Config.OpenDuration).Format(time.RFC3339), cb.lastErr)
+}
+
+func (cb *CircuitBreaker) acquire() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.refresh()
+
+	switch cb.state {
+	case BreakerState_Open:
+		return ErrCircuitOpen
+	case BreakerState_HalfOpen:
+		if cb.probing {
+			return fmt.Errorf("%w: probe already in progress", ErrCircuitOpen)
+		}
+		cb.probing = true
+	}
+	return nil
+}
+
+func (cb *CircuitBreaker) record(err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == BreakerState_HalfOpen {
+		cb.probing = false
+	}
+	if errors.Is(err, context.Canceled) || ClassifyError(err) == ErrorKind_Permanent {
+		return
+	}
+
+	switch {
+	case err == nil && cb.state == BreakerState_HalfOpen:
+		cb.successes++
+		if cb.successes >= cb.Config.HalfOpenSuccesses {
+			cb.setState(BreakerState_Closed)
+			cb.Log().Info().Msg("circuit breaker closed; database calls resumed")
+		}
+	case err == nil:
+		cb.failures = 0
+	case cb.state == BreakerState_HalfOpen:
+		cb.open(err)
+	case cb.state == BreakerState_Closed:
+		cb.failures++
+		if cb.Config.FailureThreshold > 0 && cb.failures >= cb.Config.FailureThreshold {
+			cb.open(err)
+		}
+	}
+}
+
+func (cb *CircuitBreaker) open(err error) {
+	cb.Log().Warn().Err(err).Int("failures", cb.failures).Dur("openFor", cb.Config.OpenDuration).Msg("circuit breaker opened; pausing database calls")
+	cb.openedAt = time.Now()
+	cb.lastErr = err
+	cb.setState(BreakerState_Open)
+}
+
+// refresh moves an open breaker to half-open once it has been open long enough
+func (cb *CircuitBreaker) refresh() {
+	if cb.state == BreakerState_Open && time.Since(cb.openedAt) >= cb.Config.OpenDuration {
+		cb.setState(BreakerState_HalfOpen)
+		cb.Log().Info().Msg("circuit breaker half-open; probing the database")
+	}
+}
+
+func (cb *CircuitBreaker) setState(state BreakerState) {
+	cb.state = state
+	cb.failures = 0
+	cb.successes = 0
+	cb.probing = false
+	close(cb.changed)
+	cb.changed = make(chan struct{})
+}
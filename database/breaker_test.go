@@ -0,0 +1,146 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fsufitch/censys-takehome/config"
+	"github.com/fsufitch/censys-takehome/logging"
+	"github.com/lib/pq"
+	"github.com/rs/zerolog"
+)
+
+func newTestBreaker(conf config.BreakerConfiguration) *CircuitBreaker {
+	nop := zerolog.Nop()
+	return ProvideCircuitBreaker(conf, logging.LogFunc(func() *zerolog.Logger { return &nop }))
+}
+
+func TestCircuitBreakerStates(t *testing.T) {
+	failed := func() error { return ErrConnection }
+	succeeded := func() error { return nil }
+	permanent := func() error { return &pq.Error{Code: "23505"} }
+	canceled := func() error { return context.Canceled }
+
+	tests := []struct {
+		name      string
+		conf      config.BreakerConfiguration
+		calls     []func() error
+		wantState BreakerState
+	}{
+		{
+			name:      "stays closed below the threshold",
+			conf:      config.BreakerConfiguration{FailureThreshold: 3, OpenDuration: time.Hour},
+			calls:     []func() error{failed, failed},
+			wantState: BreakerState_Closed,
+		},
+		{
+			name:      "opens at the threshold",
+			conf:      config.BreakerConfiguration{FailureThreshold: 3, OpenDuration: time.Hour},
+			calls:     []func() error{failed, failed, failed},
+			wantState: BreakerState_Open,
+		},
+		{
+			name:      "successes reset the failure count",
+			conf:      config.BreakerConfiguration{FailureThreshold: 3, OpenDuration: time.Hour},
+			calls:     []func() error{failed, failed, succeeded, failed, failed},
+			wantState: BreakerState_Closed,
+		},
+		{
+			name:      "permanent errors and cancellations don't count",
+			conf:      config.BreakerConfiguration{FailureThreshold: 1, OpenDuration: time.Hour},
+			calls:     []func() error{permanent, canceled},
+			wantState: BreakerState_Closed,
+		},
+		{
+			name:      "never opens without a threshold",
+			conf:      config.BreakerConfiguration{OpenDuration: time.Hour},
+			calls:     []func() error{failed, failed, failed, failed},
+			wantState: BreakerState_Closed,
+		},
+		{
+			name:      "half-opens after the open duration",
+			conf:      config.BreakerConfiguration{FailureThreshold: 1},
+			calls:     []func() error{failed},
+			wantState: BreakerState_HalfOpen,
+		},
+		{
+			name:      "closes after enough successful probes",
+			conf:      config.BreakerConfiguration{FailureThreshold: 1, HalfOpenSuccesses: 2},
+			calls:     []func() error{failed, succeeded, succeeded},
+			wantState: BreakerState_Closed,
+		},
+		{
+			name:      "stays half-open until enough probes succeed",
+			conf:      config.BreakerConfiguration{FailureThreshold: 1, HalfOpenSuccesses: 2},
+			calls:     []func() error{failed, succeeded},
+			wantState: BreakerState_HalfOpen,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cb := newTestBreaker(tt.conf)
+			for _, call := range tt.calls {
+				cb.Do(call)
+			}
+			if state := cb.State(); state != tt.wantState {
+				t.Errorf("state = %s, want %s", state, tt.wantState)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerOpen(t *testing.T) {
+	cb := newTestBreaker(config.BreakerConfiguration{FailureThreshold: 1, OpenDuration: time.Hour})
+	cb.Do(func() error { return ErrConnection })
+
+	called := false
+	err := cb.Do(func() error { called = true; return nil })
+	if called {
+		t.Error("call went through an open breaker")
+	}
+	if !errors.Is(err, ErrCircuitOpen) || ClassifyError(err) != ErrorKind_Transient {
+		t.Errorf("error = %v, want a transient ErrCircuitOpen", err)
+	}
+	if err := cb.Check(context.Background()); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("check = %v, want ErrCircuitOpen", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := cb.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wait = %v, want it to give up when the context is done", err)
+	}
+}
+
+func TestCircuitBreakerHalfOpenProbes(t *testing.T) {
+	cb := newTestBreaker(config.BreakerConfiguration{FailureThreshold: 1})
+	cb.Do(func() error { return ErrConnection })
+
+	probing, release := make(chan struct{}), make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- cb.Do(func() error {
+			close(probing)
+			<-release
+			return ErrConnection
+		})
+	}()
+	<-probing
+
+	if err := cb.Do(func() error { return nil }); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("second probe = %v, want ErrCircuitOpen", err)
+	}
+	close(release)
+	<-done
+
+	// The failed probe opens the breaker again; with no open duration, it is half-open right away
+	if err := cb.Check(context.Background()); err != nil {
+		t.Errorf("check = %v, want the breaker to be probing again", err)
+	}
+	if err := cb.Wait(context.Background()); err != nil {
+		t.Errorf("wait = %v, want nil", err)
+	}
+}
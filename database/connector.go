@@ -6,11 +6,13 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"sync/atomic"
 	"time"
 
 	"github.com/fsufitch/censys-takehome/config"
 	"github.com/fsufitch/censys-takehome/logging"
 	"github.com/google/uuid"
+	"github.com/google/wire"
 	"github.com/rs/zerolog"
 
 	_ "github.com/lib/pq"
@@ -28,6 +30,10 @@ type DatabaseConnector struct {
 	connectionTrigger chan struct{} // Send on this channel to cause a connection
 	newConnections    chan *sql.DB  // New connections are delivered here; if "nil" is delivered, then no connection is currently available
 	currentConections chan *sql.DB  // Used for serving connections to users of the connector
+
+	connected       atomic.Bool  // Whether a working connection is currently being served
+	reconnecting    atomic.Bool  // Whether the connection worker is currently in its connection attempt loop
+	connectAttempts atomic.Int64 // Total number of connection attempts made so far
 }
 
 func ProvideConnector(ctx context.Context, config config.PostgresConfiguration, logFunc logging.LogFunc) (*DatabaseConnector, func(), error) {
@@ -72,12 +78,15 @@ func ProvideConnector(ctx context.Context, config config.PostgresConfiguration,
 
 }
 
-func (dbc *DatabaseConnector) DB() (*sql.DB, error) {
+// DB waits for a working connection, until either the given context or the connector's context is done
+func (dbc *DatabaseConnector) DB(ctx context.Context) (*sql.DB, error) {
 	errQuit := fmt.Errorf("%w: connections unavailable (connector quit)", ErrConnection)
 	for {
 		select {
 		case <-dbc.Context.Done():
 			return nil, errQuit
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: gave up waiting for a connection: %w", ErrConnection, ctx.Err())
 		case db, ok := <-dbc.currentConections:
 			if !ok {
 				return nil, errQuit
@@ -93,6 +102,8 @@ func (dbc *DatabaseConnector) DB() (*sql.DB, error) {
 			select {
 			case <-dbc.Context.Done():
 				return nil, fmt.Errorf("%w: connections unavailable (connector quit)", ErrConnection)
+			case <-ctx.Done():
+				return nil, fmt.Errorf("%w: gave up waiting for a connection: %w", ErrConnection, ctx.Err())
 			case db, ok := <-dbc.currentConections:
 				if !ok {
 					return nil, errQuit
@@ -106,6 +117,37 @@ func (dbc *DatabaseConnector) DB() (*sql.DB, error) {
 	}
 }
 
+// Connected reports whether the connector currently has a working connection to serve
+func (dbc *DatabaseConnector) Connected() bool {
+	return dbc.connected.Load()
+}
+
+// Reconnecting reports whether the connector is currently trying to (re)connect
+func (dbc *DatabaseConnector) Reconnecting() bool {
+	return dbc.reconnecting.Load()
+}
+
+// Ping checks that the database is reachable through the connector, giving up once ctx is done
+func (dbc *DatabaseConnector) Ping(ctx context.Context) error {
+	if dbc.Reconnecting() {
+		return fmt.Errorf("%w: reconnecting", ErrConnection)
+	}
+
+	db, err := dbc.DB(ctx)
+	if err != nil {
+		return err
+	}
+	if err := db.PingContext(ctx); err != nil {
+		return fmt.Errorf("%w: ping failed: %w", ErrConnection, err)
+	}
+	return nil
+}
+
+// ConnectAttempts reports how many times the connector tried to connect, successfully or not
+func (dbc *DatabaseConnector) ConnectAttempts() int64 {
+	return dbc.connectAttempts.Load()
+}
+
 func (dbc *DatabaseConnector) Reconnect() error {
 	select {
 	case dbc.connectionTrigger <- struct{}{}:
@@ -151,6 +193,8 @@ worker:
 		}
 
 		workerLog.Info().Msg("new connection triggered")
+		dbc.connected.Store(false)
+		dbc.reconnecting.Store(true)
 
 		// Drain any connection triggers while we're actually connecting
 		stopDrainingTriggers := make(chan struct{})
@@ -174,6 +218,7 @@ worker:
 	connectSuccess:
 		for {
 			attempt++
+			dbc.connectAttempts.Add(1)
 			attemptLog := workerLog.With().Int("attempt", attempt).Logger()
 
 			// If the worker's context is done, quit
@@ -228,6 +273,8 @@ worker:
 
 		workerLog.Debug().Msg("sending new connection")
 		dbc.newConnections <- db
+		dbc.connected.Store(true)
+		dbc.reconnecting.Store(false)
 
 		stopDedupe <- struct{}{}
 	}
@@ -273,21 +320,23 @@ worker:
 	workerLog.Warn().Msg("worker terminating")
 }
 
-func (dbc *DatabaseConnector) RunTransaction(opts *sql.TxOptions, cb func(zerolog.Logger, *sql.Tx) error) error {
+// RunTransaction runs the callback in a new transaction, which is rolled back unless the callback commits it.
+// The context bounds both waiting for a connection and the transaction itself.
+func (dbc *DatabaseConnector) RunTransaction(ctx context.Context, opts *sql.TxOptions, cb func(zerolog.Logger, *sql.Tx) error) error {
 	txID, err := uuid.NewRandom()
 	if err != nil {
 		dbc.Log().Err(err).Msg("failed to create UUID")
 		return err
 	}
 
-	db, err := dbc.DB()
+	db, err := dbc.DB(ctx)
 	if err != nil {
 		return err
 	}
 
 	txLog := dbc.Log().With().Str("tx", txID.String()).Logger()
 	txLog.Debug().Msg("begin")
-	tx, err := db.BeginTx(dbc.Context, opts)
+	tx, err := db.BeginTx(ctx, opts)
 	if err != nil {
 		return err
 	}
@@ -295,3 +344,12 @@ func (dbc *DatabaseConnector) RunTransaction(opts *sql.TxOptions, cb func(zerolo
 
 	return cb(txLog, tx)
 }
+
+// ProvideDatabase provides a connector, and all the DAOs built on top of it
+var ProvideDatabase = wire.NewSet(
+	ProvideConnector,
+	ProvideSchemaDAO,
+	ProvideScanEntryDAO,
+	ProvideDeadLetterDAO,
+	ProvideScanChangeDAO,
+)
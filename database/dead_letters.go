@@ -0,0 +1,218 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/wire"
+	"github.com/lib/pq"
+	"github.com/rs/zerolog"
+)
+
+var ErrDeadLetter = errors.New("dead letter")
+var ErrDeadLetterNotFound = fmt.Errorf("%w: not found", ErrDeadLetter)
+
+type DeadLetterDAO struct {
+	*DatabaseConnector
+}
+
+// DeadLetter is a message which could not be turned into a scan entry, kept verbatim so it can be replayed later
+type DeadLetter struct {
+	ID         int64
+	MessageID  string
+	Data       []byte
+	Attributes map[string]string
+	ErrorClass string
+	Error      string
+	FirstSeen  time.Time
+	LastSeen   time.Time
+	TimesSeen  int
+}
+
+// DeadLetterFilter selects dead letters; zero-valued fields do not filter anything
+type DeadLetterFilter struct {
+	IDs        []int64
+	ErrorClass string
+	Before     time.Time // Only dead letters last seen before this time
+	AfterID    int64     // Only dead letters with a greater ID, to page through them
+	Limit      int
+}
+
+func (f DeadLetterFilter) where() (string, []any) {
+	clauses := []string{"true"}
+	args := []any{}
+	if len(f.IDs) > 0 {
+		args = append(args, pq.Array(f.IDs))
+		clauses = append(clauses, fmt.Sprintf("id = ANY($%d)", len(args)))
+	}
+	if f.ErrorClass != "" {
+		args = append(args, f.ErrorClass)
+		clauses = append(clauses, fmt.Sprintf("error_class = $%d", len(args)))
+	}
+	if !f.Before.IsZero() {
+		args = append(args, f.Before)
+		clauses = append(clauses, fmt.Sprintf("last_seen < $%d", len(args)))
+	}
+	if f.AfterID > 0 {
+		args = append(args, f.AfterID)
+		clauses = append(clauses, fmt.Sprintf("id > $%d", len(args)))
+	}
+	return strings.Join(clauses, " AND "), args
+}
+
+// addDeadLetterQuery records a dead letter, or bumps the existing one if the same message failed before
+const addDeadLetterQuery = `
+	INSERT INTO dead_letters (message_id, data, attributes, error_class, error)
+	VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (message_id) DO UPDATE SET
+		error_class = EXCLUDED.error_class,
+		error = EXCLUDED.error,
+		last_seen = now(),
+		times_seen = dead_letters.times_seen + 1
+`
+
+const selectDeadLettersQuery = `
+	SELECT id, message_id, data, attributes, error_class, error, first_seen, last_seen, times_seen
+	FROM dead_letters
+`
+
+func (dao DeadLetterDAO) AddDeadLetter(ctx context.Context, dl DeadLetter) error {
+	attributes, err := json.Marshal(dl.Attributes)
+	if err != nil {
+		return fmt.Errorf("%w: could not encode attributes: %w", ErrDeadLetter, err)
+	}
+	if dl.Attributes == nil {
+		attributes = []byte("{}")
+	}
+
+	return dao.RunTransaction(ctx, nil, func(L zerolog.Logger, tx *sql.Tx) error {
+		L = L.With().Str("action", "addDeadLetter").Str("msgID", dl.MessageID).Logger()
+
+		L.Debug().Msg("running query")
+		_, err := tx.ExecContext(ctx, addDeadLetterQuery,
+			dl.MessageID, dl.Data, attributes, dl.ErrorClass, dl.Error,
+		)
+		if err != nil {
+			return fmt.Errorf("%w: query failed: %w", ErrDeadLetter, err)
+		}
+
+		L.Debug().Msg("commiting")
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("%w: commit failed: %w", ErrDeadLetter, err)
+		}
+
+		L.Debug().Msg("dead letter recorded")
+		return nil
+	})
+}
+
+func (dao DeadLetterDAO) ListDeadLetters(ctx context.Context, filter DeadLetterFilter) ([]DeadLetter, error) {
+	where, args := filter.where()
+	query := selectDeadLettersQuery + " WHERE " + where + " ORDER BY id"
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	deadLetters := []DeadLetter{}
+	err := dao.RunTransaction(ctx, &sql.TxOptions{ReadOnly: true}, func(L zerolog.Logger, tx *sql.Tx) error {
+		L = L.With().Str("action", "listDeadLetters").Logger()
+
+		L.Debug().Msg("running query")
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return fmt.Errorf("%w: query failed: %w", ErrDeadLetter, err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			dl, err := scanDeadLetter(rows)
+			if err != nil {
+				return err
+			}
+			deadLetters = append(deadLetters, dl)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("%w: query failed: %w", ErrDeadLetter, err)
+		}
+
+		L.Debug().Int("count", len(deadLetters)).Msg("listed dead letters")
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deadLetters, nil
+}
+
+func (dao DeadLetterDAO) GetDeadLetter(ctx context.Context, id int64) (DeadLetter, error) {
+	deadLetters, err := dao.ListDeadLetters(ctx, DeadLetterFilter{IDs: []int64{id}})
+	if err != nil {
+		return DeadLetter{}, err
+	}
+	if len(deadLetters) == 0 {
+		return DeadLetter{}, fmt.Errorf("%w (id=%d)", ErrDeadLetterNotFound, id)
+	}
+	return deadLetters[0], nil
+}
+
+// deleteDeadLetters deletes dead letters by ID within an ongoing transaction
+func deleteDeadLetters(ctx context.Context, tx *sql.Tx, ids []int64) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM dead_letters WHERE id = ANY($1)", pq.Array(ids)); err != nil {
+		return fmt.Errorf("%w: deleting dead letters failed: %w", ErrDeadLetter, err)
+	}
+	return nil
+}
+
+// PurgeDeadLetters deletes the dead letters matching the filter, and returns how many there were
+func (dao DeadLetterDAO) PurgeDeadLetters(ctx context.Context, filter DeadLetterFilter) (int64, error) {
+	where, args := filter.where()
+	query := "DELETE FROM dead_letters WHERE " + where
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query = fmt.Sprintf("DELETE FROM dead_letters WHERE id IN (SELECT id FROM dead_letters WHERE %s ORDER BY id LIMIT $%d)", where, len(args))
+	}
+
+	var deleted int64
+	err := dao.RunTransaction(ctx, nil, func(L zerolog.Logger, tx *sql.Tx) error {
+		L = L.With().Str("action", "purgeDeadLetters").Logger()
+
+		L.Debug().Msg("running query")
+		result, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return fmt.Errorf("%w: query failed: %w", ErrDeadLetter, err)
+		}
+		if deleted, err = result.RowsAffected(); err != nil {
+			return fmt.Errorf("%w: query failed: %w", ErrDeadLetter, err)
+		}
+
+		L.Debug().Msg("commiting")
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("%w: commit failed: %w", ErrDeadLetter, err)
+		}
+
+		L.Debug().Int64("deleted", deleted).Msg("purged dead letters")
+		return nil
+	})
+	return deleted, err
+}
+
+func scanDeadLetter(rows *sql.Rows) (DeadLetter, error) {
+	dl := DeadLetter{}
+	var attributes []byte
+	err := rows.Scan(&dl.ID, &dl.MessageID, &dl.Data, &attributes, &dl.ErrorClass, &dl.Error, &dl.FirstSeen, &dl.LastSeen, &dl.TimesSeen)
+	if err != nil {
+		return DeadLetter{}, fmt.Errorf("%w: scanning result failed: %w", ErrDeadLetter, err)
+	}
+	if err := json.Unmarshal(attributes, &dl.Attributes); err != nil {
+		return DeadLetter{}, fmt.Errorf("%w: could not decode attributes: %w", ErrDeadLetter, err)
+	}
+	return dl, nil
+}
+
+var ProvideDeadLetterDAO = wire.Struct(new(DeadLetterDAO), "*")
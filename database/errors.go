@@ -0,0 +1,67 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/lib/pq"
+)
+
+// ErrorKind says whether a failed database call is worth making again
+type ErrorKind int
+
+const (
+	ErrorKind_Unknown   ErrorKind = iota // Can't tell; treat it as transient, but don't count on it
+	ErrorKind_Transient                  // The database or the connection to it is having trouble; it may well work later
+	ErrorKind_Permanent                  // Postgres rejected what was sent (e.g. a bad value); it will fail the same way every time
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrorKind_Transient:
+		return "transient"
+	case ErrorKind_Permanent:
+		return "permanent"
+	default:
+		return "unknown"
+	}
+}
+
+// SQLSTATE classes, see https://www.postgresql.org/docs/current/errcodes-appendix.html
+var sqlStateKinds = map[pq.ErrorClass]ErrorKind{
+	"08": ErrorKind_Transient, // Connection exception
+	"40": ErrorKind_Transient, // Transaction rollback (serialization failure, deadlock)
+	"53": ErrorKind_Transient, // Insufficient resources (disk full, out of memory, too many connections)
+	"55": ErrorKind_Transient, // Object not in prerequisite state (e.g. lock not available)
+	"57": ErrorKind_Transient, // Operator intervention (shutdown, query canceled)
+	"58": ErrorKind_Transient, // System error (I/O error)
+
+	"22": ErrorKind_Permanent, // Data exception (invalid text representation, value too long, bad byte sequence)
+	"23": ErrorKind_Permanent, // Integrity constraint violation
+	"54": ErrorKind_Permanent, // Program limit exceeded (e.g. a response too long for its index or tsvector)
+}
+
+// ClassifyError tells what kind of failure a database error is. Errors from anything but the database are unknown.
+func ClassifyError(err error) ErrorKind {
+	pqErr := &pq.Error{}
+	switch {
+	case err == nil:
+		return ErrorKind_Unknown
+	case errors.As(err, &pqErr):
+		return sqlStateKinds[pqErr.Code.Class()] // Unknown if the class is not listed
+	case errors.Is(err, ErrConnection),
+		errors.Is(err, driver.ErrBadConn),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, context.DeadlineExceeded):
+		return ErrorKind_Transient
+	}
+
+	netErr := net.Error(nil)
+	if errors.As(err, &netErr) {
+		return ErrorKind_Transient
+	}
+	return ErrorKind_Unknown
+}
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS scan_entries (
+	ip inet NOT NULL,
+	port integer NOT NULL,
+	service varchar NOT NULL,
+	updated_on timestamp without time zone NOT NULL,
+	data text,
+	PRIMARY KEY (ip, port, service)
+);
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS dead_letters (
+	id bigserial PRIMARY KEY,
+	message_id varchar NOT NULL UNIQUE,
+	data bytea NOT NULL,
+	attributes jsonb NOT NULL DEFAULT '{}',
+	error_class varchar NOT NULL,
+	error text NOT NULL,
+	first_seen timestamp with time zone NOT NULL DEFAULT now(),
+	last_seen timestamp with time zone NOT NULL DEFAULT now(),
+	times_seen integer NOT NULL DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS dead_letters_error_class ON dead_letters (error_class);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS scan_history;
+DROP TABLE IF EXISTS scan_contents;
@@ -0,0 +1,16 @@
+-- Every distinct response is only stored once, keyed by its SHA-256 hash
+CREATE TABLE scan_contents (
+	content_hash bytea PRIMARY KEY,
+	data text
+);
+
+-- One row per observation of a service; the response itself lives in scan_contents
+CREATE TABLE scan_history (
+	ip inet NOT NULL,
+	port integer NOT NULL,
+	service varchar NOT NULL,
+	observed_on timestamp without time zone NOT NULL,
+	content_hash bytea NOT NULL REFERENCES scan_contents (content_hash),
+	recorded_at timestamp with time zone NOT NULL DEFAULT now(),
+	PRIMARY KEY (ip, port, service, observed_on)
+);
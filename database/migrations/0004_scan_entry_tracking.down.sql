@@ -0,0 +1,5 @@
+ALTER TABLE scan_entries
+	DROP COLUMN IF EXISTS first_seen,
+	DROP COLUMN IF EXISTS last_changed,
+	DROP COLUMN IF EXISTS times_seen,
+	DROP COLUMN IF EXISTS message_id;
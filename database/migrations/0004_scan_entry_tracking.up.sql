@@ -0,0 +1,12 @@
+ALTER TABLE scan_entries
+	ADD COLUMN first_seen timestamp without time zone,
+	ADD COLUMN last_changed timestamp without time zone,
+	ADD COLUMN times_seen integer NOT NULL DEFAULT 1,
+	ADD COLUMN message_id varchar;
+
+-- Existing rows only ever had a single known observation
+UPDATE scan_entries SET first_seen = updated_on, last_changed = updated_on;
+
+ALTER TABLE scan_entries
+	ALTER COLUMN first_seen SET NOT NULL,
+	ALTER COLUMN last_changed SET NOT NULL;
@@ -0,0 +1,16 @@
+-- One row per time a service's response actually changed; the responses themselves live in scan_contents
+CREATE TABLE scan_changes (
+	id bigserial PRIMARY KEY,
+	ip inet NOT NULL,
+	port integer NOT NULL,
+	service varchar NOT NULL,
+	message_id varchar,
+	old_hash bytea NOT NULL,
+	new_hash bytea NOT NULL,
+	old_updated_on timestamp without time zone NOT NULL,
+	new_updated_on timestamp without time zone NOT NULL,
+	diff text,
+	recorded_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX scan_changes_key_idx ON scan_changes (ip, port, service, new_updated_on);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS scan_entries_ip_gist_idx;
+DROP INDEX IF EXISTS scan_entries_service_idx;
+DROP INDEX IF EXISTS scan_entries_port_idx;
+DROP INDEX IF EXISTS scan_entries_updated_idx;
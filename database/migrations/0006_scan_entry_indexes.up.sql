@@ -0,0 +1,9 @@
+-- Listing by update time, with keyset pagination over (updated_on, ip, port, service)
+CREATE INDEX scan_entries_updated_idx ON scan_entries (updated_on, ip, port, service);
+
+-- Listing by port or service alone, which the primary key can't serve
+CREATE INDEX scan_entries_port_idx ON scan_entries (port);
+CREATE INDEX scan_entries_service_idx ON scan_entries (service);
+
+-- CIDR containment (<<=)
+CREATE INDEX scan_entries_ip_gist_idx ON scan_entries USING gist (ip inet_ops);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS scan_entries_data_trgm_idx;
+DROP INDEX IF EXISTS scan_entries_data_tsv_idx;
+ALTER TABLE scan_entries DROP COLUMN IF EXISTS data_tsv;
+-- pg_trgm stays; it may have been there before, and other things in the database may use it
@@ -0,0 +1,10 @@
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+-- Responses are banners rather than prose, so they are tokenized without stemming or stop words
+ALTER TABLE scan_entries
+	ADD COLUMN data_tsv tsvector GENERATED ALWAYS AS (to_tsvector('simple', coalesce(data, ''))) STORED;
+
+CREATE INDEX scan_entries_data_tsv_idx ON scan_entries USING gin (data_tsv);
+
+-- Substring and pattern matches (LIKE/ILIKE), e.g. from data: search terms
+CREATE INDEX scan_entries_data_trgm_idx ON scan_entries USING gin (data gin_trgm_ops);
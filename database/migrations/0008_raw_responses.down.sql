@@ -0,0 +1,7 @@
+ALTER TABLE scan_contents
+	DROP COLUMN IF EXISTS raw,
+	DROP COLUMN IF EXISTS encoding;
+
+ALTER TABLE scan_entries
+	DROP COLUMN IF EXISTS raw,
+	DROP COLUMN IF EXISTS encoding;
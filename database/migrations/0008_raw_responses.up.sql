@@ -0,0 +1,9 @@
+-- Responses which aren't valid UTF-8 keep their exact bytes in raw, while data holds a text rendering of them.
+-- raw is NULL whenever data already is the exact response.
+ALTER TABLE scan_entries
+	ADD COLUMN raw bytea,
+	ADD COLUMN encoding varchar NOT NULL DEFAULT 'utf-8';
+
+ALTER TABLE scan_contents
+	ADD COLUMN raw bytea,
+	ADD COLUMN encoding varchar NOT NULL DEFAULT 'utf-8';
@@ -0,0 +1 @@
+ALTER TABLE scan_entries DROP COLUMN IF EXISTS metadata;
@@ -0,0 +1,2 @@
+-- Free-form metadata about how the latest response was obtained (only some data versions carry any); NULL if none
+ALTER TABLE scan_entries ADD COLUMN metadata jsonb;
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS change_outbox;
@@ -0,0 +1,14 @@
+-- Changes recorded in the same transaction as the upsert which made them, waiting to be relayed to the change sink.
+-- Both responses live in scan_contents; rows are removed once the sink accepted their events.
+CREATE TABLE change_outbox (
+	id bigserial PRIMARY KEY,
+	ip inet NOT NULL,
+	port integer NOT NULL,
+	service varchar NOT NULL,
+	message_id varchar,
+	old_hash bytea NOT NULL REFERENCES scan_contents (content_hash),
+	new_hash bytea NOT NULL REFERENCES scan_contents (content_hash),
+	old_updated_on timestamp without time zone NOT NULL,
+	new_updated_on timestamp without time zone NOT NULL,
+	recorded_at timestamp with time zone NOT NULL DEFAULT now()
+);
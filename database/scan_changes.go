@@ -0,0 +1,210 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/google/wire"
+	"github.com/lib/pq"
+	"github.com/rs/zerolog"
+)
+
+var ErrScanChange = errors.New("scan change")
+
+type ScanChangeDAO struct {
+	*DatabaseConnector
+}
+
+// ScanChange records a service's response being replaced by a different one
+type ScanChange struct {
+	Key        ScanEntryKey
+	MessageID  string // ID of the message carrying the new response
+	OldHash    []byte
+	NewHash    []byte
+	OldUpdated time.Time
+	NewUpdated time.Time
+	Diff       string
+}
+
+const addChangesQuery = `
+	INSERT INTO scan_changes (ip, port, service, message_id, old_hash, new_hash, old_updated_on, new_updated_on, diff)
+	SELECT * FROM unnest($1::inet[], $2::integer[], $3::varchar[], $4::varchar[], $5::bytea[], $6::bytea[],
+		$7::timestamp[], $8::timestamp[], $9::text[])
+`
+
+func (dao ScanChangeDAO) AddChanges(ctx context.Context, changes []ScanChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	var (
+		ips        = make([]string, 0, len(changes))
+		ports      = make([]int64, 0, len(changes))
+		services   = make([]string, 0, len(changes))
+		messageIDs = make([]string, 0, len(changes))
+		oldHashes  = make([][]byte, 0, len(changes))
+		newHashes  = make([][]byte, 0, len(changes))
+		oldUpdated = make([]string, 0, len(changes))
+		newUpdated = make([]string, 0, len(changes))
+		diffs      = make([]string, 0, len(changes))
+	)
+	for _, c := range changes {
+		ips = append(ips, c.Key.IP)
+		ports = append(ports, int64(c.Key.Port))
+		services = append(services, c.Key.Service)
+		messageIDs = append(messageIDs, c.MessageID)
+		oldHashes = append(oldHashes, c.OldHash)
+		newHashes = append(newHashes, c.NewHash)
+		oldUpdated = append(oldUpdated, c.OldUpdated.Format(timestampLayout))
+		newUpdated = append(newUpdated, c.NewUpdated.Format(timestampLayout))
+		diffs = append(diffs, c.Diff)
+	}
+
+	return dao.RunTransaction(ctx, nil, func(L zerolog.Logger, tx *sql.Tx) error {
+		L = L.With().Str("action", "addChanges").Int("changes", len(changes)).Logger()
+
+		L.Debug().Msg("running query")
+		_, err := tx.ExecContext(ctx, addChangesQuery,
+			pq.Array(ips), pq.Array(ports), pq.Array(services), pq.Array(messageIDs), pq.Array(oldHashes),
+			pq.Array(newHashes), pq.Array(oldUpdated), pq.Array(newUpdated), pq.Array(diffs),
+		)
+		if err != nil {
+			return fmt.Errorf("%w: query failed: %w", ErrScanChange, err)
+		}
+
+		L.Debug().Msg("commiting")
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("%w: query failed: %w", ErrScanChange, err)
+		}
+
+		L.Debug().Msg("changes recorded")
+		return nil
+	})
+}
+
+// PendingChange is a change waiting in the outbox, with both the entry as it was and the entry replacing it
+type PendingChange struct {
+	ID  int64
+	Old ScanEntry
+	New ScanEntry
+}
+
+const addOutboxQuery = `
+	INSERT INTO change_outbox (ip, port, service, message_id, old_hash, new_hash, old_updated_on, new_updated_on)
+	SELECT * FROM unnest($1::inet[], $2::integer[], $3::varchar[], $4::varchar[], $5::bytea[], $6::bytea[],
+		$7::timestamp[], $8::timestamp[])
+`
+
+// claimOutboxQuery locks the oldest pending changes which no one else is relaying, along with both responses
+const claimOutboxQuery = `
+	SELECT o.id, host(o.ip), o.port, o.service, coalesce(o.message_id, ''), o.old_updated_on, o.new_updated_on,
+		coalesce(oc.data, ''), oc.raw, oc.encoding, coalesce(nc.data, ''), nc.raw, nc.encoding
+	FROM change_outbox o
+	JOIN scan_contents oc ON oc.content_hash = o.old_hash
+	JOIN scan_contents nc ON nc.content_hash = o.new_hash
+	ORDER BY o.id
+	LIMIT $1
+	FOR UPDATE OF o SKIP LOCKED
+`
+
+const deleteOutboxQuery = `DELETE FROM change_outbox WHERE id = ANY($1::bigint[])`
+
+// addOutbox records changes made by an ongoing transaction, to be relayed once it commits. old and new are parallel;
+// both of their responses must be stored in scan_contents already.
+func addOutbox(ctx context.Context, tx *sql.Tx, old []ScanEntry, new []ScanEntry) error {
+	if len(new) == 0 {
+		return nil
+	}
+
+	var (
+		ips        = make([]string, len(new))
+		ports      = make([]int64, len(new))
+		services   = make([]string, len(new))
+		messageIDs = make([]string, len(new))
+		oldHashes  = make([][]byte, len(new))
+		newHashes  = make([][]byte, len(new))
+		oldUpdated = make([]string, len(new))
+		newUpdated = make([]string, len(new))
+	)
+	for i := range new {
+		ips[i] = new[i].IP.String()
+		ports[i] = int64(new[i].Port)
+		services[i] = new[i].Service
+		messageIDs[i] = new[i].MessageID
+		oldHashes[i] = ContentHash(old[i].Content())
+		newHashes[i] = ContentHash(new[i].Content())
+		oldUpdated[i] = old[i].Updated.Format(timestampLayout)
+		newUpdated[i] = new[i].Updated.Format(timestampLayout)
+	}
+
+	_, err := tx.ExecContext(ctx, addOutboxQuery,
+		pq.Array(ips), pq.Array(ports), pq.Array(services), pq.Array(messageIDs), pq.Array(oldHashes),
+		pq.Array(newHashes), pq.Array(oldUpdated), pq.Array(newUpdated),
+	)
+	if err != nil {
+		return fmt.Errorf("%w: recording changes failed: %w", ErrScanChange, err)
+	}
+	return nil
+}
+
+// RelayChanges hands up to limit of the oldest pending changes to relay, and removes them from the outbox if it
+// succeeds. Changes being relayed by someone else are skipped. It returns how many changes were relayed.
+func (dao ScanChangeDAO) RelayChanges(ctx context.Context, limit int, relay func([]PendingChange) error) (int, error) {
+	relayed := 0
+	err := dao.RunTransaction(ctx, nil, func(L zerolog.Logger, tx *sql.Tx) error {
+		L = L.With().Str("action", "relayChanges").Logger()
+
+		L.Debug().Msg("claiming changes")
+		rows, err := tx.QueryContext(ctx, claimOutboxQuery, limit)
+		if err != nil {
+			return fmt.Errorf("%w: query failed: %w", ErrScanChange, err)
+		}
+		defer rows.Close()
+
+		changes := []PendingChange{}
+		ids := []int64{}
+		for rows.Next() {
+			var ip string
+			c := PendingChange{}
+			err := rows.Scan(&c.ID, &ip, &c.New.Port, &c.New.Service, &c.New.MessageID, &c.Old.Updated, &c.New.Updated,
+				&c.Old.Data, &c.Old.Raw, &c.Old.Encoding, &c.New.Data, &c.New.Raw, &c.New.Encoding)
+			if err != nil {
+				return fmt.Errorf("%w: scanning result failed: %w", ErrScanChange, err)
+			}
+			c.New.IP = net.ParseIP(ip)
+			c.Old.Updated, c.New.Updated = localWallClock(c.Old.Updated), localWallClock(c.New.Updated)
+			c.Old.IP, c.Old.Port, c.Old.Service = c.New.IP, c.New.Port, c.New.Service
+			changes = append(changes, c)
+			ids = append(ids, c.ID)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("%w: query failed: %w", ErrScanChange, err)
+		}
+		if len(changes) == 0 {
+			return nil
+		}
+
+		if err := relay(changes); err != nil {
+			return err
+		}
+
+		L.Debug().Int("changes", len(changes)).Msg("removing relayed changes")
+		if _, err := tx.ExecContext(ctx, deleteOutboxQuery, pq.Array(ids)); err != nil {
+			return fmt.Errorf("%w: query failed: %w", ErrScanChange, err)
+		}
+
+		L.Debug().Msg("commiting")
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("%w: query failed: %w", ErrScanChange, err)
+		}
+		relayed = len(changes)
+		return nil
+	})
+	return relayed, err
+}
+
+var ProvideScanChangeDAO = wire.Struct(new(ScanChangeDAO), "*")
@@ -1,13 +1,18 @@
 package database
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"time"
 
-	"github.com/google/wire"
+	"github.com/fsufitch/censys-takehome/config"
+	"github.com/lib/pq"
 	"github.com/rs/zerolog"
 )
 
@@ -15,49 +20,396 @@ var ErrScanEntry = errors.New("database schema")
 
 type ScanEntryDAO struct {
 	*DatabaseConnector
+	RecordChanges bool // Whether to record changed responses in the outbox, for a server to relay as change events
 }
 
 type ScanEntry struct {
-	IP      net.IP
+	IP        net.IP
+	Port      uint32
+	Service   string
+	Updated   time.Time
+	Data      string
+	Raw       []byte            // Exact response bytes, only if Data is not exactly them (i.e. the response was not UTF-8)
+	Encoding  string            // How Data was rendered from the response; "utf-8" if it is the response as-is
+	MessageID string            // ID of the message the entry came from
+	Metadata  map[string]string // Extra information about how the response was obtained, if the data version has any
+
+	// Maintained by the database; ignored when adding entries
+	FirstSeen   time.Time // Earliest observation
+	LastChanged time.Time // When Data last actually changed
+	TimesSeen   int       // Number of distinct observations
+}
+
+// ScanEntryKey is the primary key of a scan entry, in a form usable as a map key
+type ScanEntryKey struct {
+	IP      string
 	Port    uint32
 	Service string
-	Updated time.Time
-	Data    string
 }
 
-const upsertEntryQuery = `
-	INSERT INTO scan_entries (ip, port, service, updated_on, data)
-	VALUES ($1, $2, $3, $4, $5)
+// Content is the exact response bytes
+func (e ScanEntry) Content() []byte {
+	if e.Raw != nil {
+		return e.Raw
+	}
+	return []byte(e.Data)
+}
+
+func (e ScanEntry) Key() ScanEntryKey {
+	return ScanEntryKey{IP: e.IP.String(), Port: e.Port, Service: e.Service}
+}
+
+// Less orders keys, so that batches always lock rows in the same order
+func (k ScanEntryKey) Less(other ScanEntryKey) bool {
+	if k.IP != other.IP {
+		return k.IP < other.IP
+	}
+	if k.Port != other.Port {
+		return k.Port < other.Port
+	}
+	return k.Service < other.Service
+}
+
+// UpsertResult describes what an upsert actually did to the stored row
+type UpsertResult int
+
+const (
+	UpsertResult_Undefined UpsertResult = iota
+	UpsertResult_Inserted
+	UpsertResult_Updated
+	UpsertResult_Stale // The stored row (or another entry in the same batch) is as new or newer, so this entry was left out
+)
+
+func (r UpsertResult) String() string {
+	switch r {
+	case UpsertResult_Inserted:
+		return "inserted"
+	case UpsertResult_Updated:
+		return "updated"
+	case UpsertResult_Stale:
+		return "stale"
+	default:
+		return "undefined"
+	}
+}
+
+// upsertEntriesQuery inserts many rows at once, passed in as parallel arrays. The data (and message ID) of an existing
+// row is only overwritten if the incoming entry is strictly newer, but older observations still count towards first_seen.
+// times_seen is incremented by the number of observations newly recorded in the history, so redeliveries never count twice.
+// Rows with neither a newer entry nor new observations are left alone, and are not returned. Of the returned rows,
+// xmax = 0 tells apart inserts from updates.
+const upsertEntriesQuery = `
+	INSERT INTO scan_entries AS e (ip, port, service, updated_on, data, raw, encoding, message_id, metadata, first_seen, last_changed, times_seen)
+	SELECT ip, port, service, updated_on, data, NULLIF(raw, ''::bytea), encoding, message_id, NULLIF(metadata, '')::jsonb, first_seen, updated_on, times_seen
+	FROM unnest($1::inet[], $2::integer[], $3::varchar[], $4::timestamp[], $5::text[], $6::varchar[], $7::timestamp[], $8::integer[],
+			$9::bytea[], $10::varchar[], $11::text[])
+		AS batch (ip, port, service, updated_on, data, message_id, first_seen, times_seen, raw, encoding, metadata)
 	ON CONFLICT (ip, port, service) DO UPDATE SET
-		updated_on = $4,
-		data = $5
+		updated_on = GREATEST(e.updated_on, EXCLUDED.updated_on),
+		data = CASE WHEN EXCLUDED.updated_on > e.updated_on THEN EXCLUDED.data ELSE e.data END,
+		raw = CASE WHEN EXCLUDED.updated_on > e.updated_on THEN EXCLUDED.raw ELSE e.raw END,
+		encoding = CASE WHEN EXCLUDED.updated_on > e.updated_on THEN EXCLUDED.encoding ELSE e.encoding END,
+		message_id = CASE WHEN EXCLUDED.updated_on > e.updated_on THEN EXCLUDED.message_id ELSE e.message_id END,
+		metadata = CASE WHEN EXCLUDED.updated_on > e.updated_on THEN EXCLUDED.metadata ELSE e.metadata END,
+		last_changed = CASE
+			WHEN EXCLUDED.updated_on > e.updated_on AND (EXCLUDED.data, EXCLUDED.raw) IS DISTINCT FROM (e.data, e.raw)
+				THEN EXCLUDED.updated_on
+			ELSE e.last_changed
+		END,
+		first_seen = LEAST(e.first_seen, EXCLUDED.first_seen),
+		times_seen = e.times_seen + EXCLUDED.times_seen
+	WHERE e.updated_on <> EXCLUDED.updated_on OR EXCLUDED.times_seen > 0
+	RETURNING host(e.ip), e.port, e.service, (e.xmax = 0) AS inserted, e.updated_on
 `
 
-func (dao ScanEntryDAO) AddEntry(e ScanEntry) error {
-	return dao.RunTransaction(nil, func(L zerolog.Logger, tx *sql.Tx) error {
-		L = L.With().Str("action", "initSchema").Logger()
+// entryColumns are the columns of scan_entries (aliased as e) read by scanEntry
+const entryColumns = `host(e.ip), e.port, e.service, e.updated_on, e.data, e.raw, e.encoding, coalesce(e.message_id, ''),
+	e.first_seen, e.last_changed, e.times_seen, e.metadata`
+
+// lockEntriesQuery locks and returns the stored rows for many keys, passed in as parallel arrays, in the order of the arrays
+const lockEntriesQuery = `
+	SELECT ` + entryColumns + `
+	FROM scan_entries e
+	JOIN unnest($1::inet[], $2::integer[], $3::varchar[]) WITH ORDINALITY AS k (ip, port, service, n)
+		ON e.ip = k.ip AND e.port = k.port AND e.service = k.service
+	ORDER BY k.n
+	FOR UPDATE OF e
+`
+
+// timestampLayout formats timestamps for the "timestamp without time zone" column, keeping the wall clock
+const timestampLayout = "2006-01-02 15:04:05.999999"
+
+// wallClockAfter tells whether a is after b as the database sees them, going by their wall clocks alone
+func wallClockAfter(a, b time.Time) bool {
+	const layout = "2006-01-02 15:04:05.000000" // Fixed width, so that it sorts like the time
+	return a.Format(layout) > b.Format(layout)
+}
+
+// localWallClock reads a time scanned from a "timestamp without time zone" column, which the driver tags as UTC,
+// back into the local time zone it was written in
+func localWallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.Local)
+}
+
+// AddEntry upserts a single entry
+func (dao ScanEntryDAO) AddEntry(ctx context.Context, e ScanEntry) (UpsertResult, error) {
+	results, err := dao.AddEntries(ctx, []ScanEntry{e})
+	if err != nil {
+		return UpsertResult_Undefined, err
+	}
+	return results[0], nil
+}
+
+// AddEntries upserts a batch of entries in a single transaction. The returned results are in the same order as the entries.
+// If multiple entries share a key, only the newest of them is written; the rest are reported as stale.
+// Every entry, stale or not, is also recorded in the history. Entries which replaced a different response are recorded
+// in the change outbox within the same transaction, so their change events are relayed if and only if they are written.
+func (dao ScanEntryDAO) AddEntries(ctx context.Context, entries []ScanEntry) ([]UpsertResult, error) {
+	return dao.addEntries(ctx, entries, nil)
+}
+
+// AddReplayedEntries upserts entries decoded from dead letters like AddEntries, and deletes those dead letters in the
+// same transaction, so that they are either replayed and gone, or neither
+func (dao ScanEntryDAO) AddReplayedEntries(ctx context.Context, entries []ScanEntry, deadLetterIDs []int64) ([]UpsertResult, error) {
+	return dao.addEntries(ctx, entries, func(tx *sql.Tx) error {
+		return deleteDeadLetters(ctx, tx, deadLetterIDs)
+	})
+}
+
+// addEntries upserts entries, calling also within the same transaction (if not nil) before committing
+func (dao ScanEntryDAO) addEntries(ctx context.Context, entries []ScanEntry, also func(*sql.Tx) error) ([]UpsertResult, error) {
+	results := make([]UpsertResult, len(entries))
+	if len(entries) == 0 {
+		return results, nil
+	}
+
+	// Postgres refuses to update the same row twice in one statement, so aggregate by key first
+	type keyBatch struct {
+		newest    int
+		firstSeen time.Time
+	}
+	batches := map[ScanEntryKey]*keyBatch{}
+	for i, e := range entries {
+		key := e.Key()
+		kb, ok := batches[key]
+		if !ok {
+			batches[key] = &keyBatch{newest: i, firstSeen: e.Updated}
+			continue
+		}
+
+		if e.Updated.Before(kb.firstSeen) {
+			kb.firstSeen = e.Updated
+		}
+		if entries[kb.newest].Updated.After(e.Updated) {
+			results[i] = UpsertResult_Stale
+		} else {
+			results[kb.newest] = UpsertResult_Stale
+			kb.newest = i
+		}
+	}
+
+	keys := make([]ScanEntryKey, 0, len(batches))
+	for key := range batches {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Less(keys[j]) })
+
+	var (
+		ips        = make([]string, 0, len(keys))
+		ports      = make([]int64, 0, len(keys))
+		services   = make([]string, 0, len(keys))
+		updated    = make([]string, 0, len(keys))
+		data       = make([]string, 0, len(keys))
+		messageIDs = make([]string, 0, len(keys))
+		firstSeen  = make([]string, 0, len(keys))
+		raws       = make([][]byte, 0, len(keys)) // Empty for none; pq can't encode NULLs in bytea arrays
+		encodings  = make([]string, 0, len(keys))
+		metadata   = make([]string, 0, len(keys)) // JSON, or empty for none
+	)
+	for _, key := range keys {
+		kb := batches[key]
+		e := entries[kb.newest]
+		ips = append(ips, e.IP.String())
+		ports = append(ports, int64(e.Port))
+		services = append(services, e.Service)
+		updated = append(updated, e.Updated.Format(timestampLayout))
+		data = append(data, e.Data)
+		messageIDs = append(messageIDs, e.MessageID)
+		firstSeen = append(firstSeen, kb.firstSeen.Format(timestampLayout))
+		raws = append(raws, e.Raw)
+		encodings = append(encodings, e.encoding())
+		metadata = append(metadata, e.MetadataJSON())
+	}
+
+	err := dao.RunTransaction(ctx, nil, func(L zerolog.Logger, tx *sql.Tx) error {
+		L = L.With().Str("action", "addEntries").Int("entries", len(entries)).Int("unique", len(keys)).Logger()
+
+		// Lock the existing rows first, so that what is read is exactly what the upsert replaces
+		L.Debug().Msg("locking existing rows")
+		stored, err := lockEntries(ctx, tx, ips, ports, services)
+		if err != nil {
+			return err
+		}
+
+		// The history tells which observations are new, and so how much each row is seen more often
+		L.Debug().Msg("recording history")
+		added, err := addHistory(ctx, tx, entries)
+		if err != nil {
+			return err
+		}
+		timesSeen := make([]int64, len(keys))
+		for i, key := range keys {
+			timesSeen[i] = int64(added[key])
+		}
 
 		L.Debug().Msg("running query")
-		_, err := tx.ExecContext(dao.Context, upsertEntryQuery,
-			e.IP.String(), e.Port, e.Service, e.Updated, e.Data,
+		rows, err := tx.QueryContext(ctx, upsertEntriesQuery,
+			pq.Array(ips), pq.Array(ports), pq.Array(services), pq.Array(updated), pq.Array(data),
+			pq.Array(messageIDs), pq.Array(firstSeen), pq.Array(timesSeen), pq.Array(raws), pq.Array(encodings),
+			pq.Array(metadata),
 		)
-
 		if err != nil {
 			return fmt.Errorf("%w: query failed: %w", ErrScanEntry, err)
 		}
+		defer rows.Close()
+
+		written := map[ScanEntryKey]UpsertResult{}
+		for rows.Next() {
+			var ip string
+			var key ScanEntryKey
+			var inserted bool
+			var rowUpdated time.Time
+			if err := rows.Scan(&ip, &key.Port, &key.Service, &inserted, &rowUpdated); err != nil {
+				return fmt.Errorf("%w: scanning result failed: %w", ErrScanEntry, err)
+			}
+			key.IP = net.ParseIP(ip).String()
+
+			kb, ok := batches[key]
+			switch {
+			case !ok:
+				return fmt.Errorf("%w: upsert returned a row that was not in the batch (%v)", ErrScanEntry, key)
+			case inserted:
+				written[key] = UpsertResult_Inserted
+			case stored[key] != nil && !wallClockAfter(entries[kb.newest].Updated, stored[key].Updated):
+				// Only the counters were touched; the stored data is as new or newer
+			case rowUpdated.Format(timestampLayout) == entries[kb.newest].Updated.Format(timestampLayout):
+				written[key] = UpsertResult_Updated
+			default:
+				// Only the counters were touched; a concurrent write stored newer data
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("%w: query failed: %w", ErrScanEntry, err)
+		}
+
+		changedFrom := []ScanEntry{}
+		changedTo := []ScanEntry{}
+		for _, key := range keys {
+			kb := batches[key]
+			result, ok := written[key]
+			if !ok {
+				result = UpsertResult_Stale
+			}
+			results[kb.newest] = result
+
+			// stored is nil if the row was inserted concurrently, after it was locked
+			if prev := stored[key]; result == UpsertResult_Updated && prev != nil && !bytes.Equal(prev.Content(), entries[kb.newest].Content()) {
+				changedFrom = append(changedFrom, *prev)
+				changedTo = append(changedTo, entries[kb.newest])
+			}
+		}
+
+		if len(changedTo) > 0 && dao.RecordChanges {
+			// The old responses are normally stored already, unless they were recorded before the history was
+			L.Debug().Int("changes", len(changedTo)).Msg("recording changes")
+			if err := addContents(ctx, tx, changedFrom); err != nil {
+				return err
+			}
+			if err := addOutbox(ctx, tx, changedFrom, changedTo); err != nil {
+				return err
+			}
+		}
+
+		if also != nil {
+			if err := also(tx); err != nil {
+				return err
+			}
+		}
 
 		L.Debug().Msg("commiting")
 		if err := tx.Commit(); err != nil {
 			return fmt.Errorf("%w: query failed: %w", ErrScanEntry, err)
 		}
 
-		L.Debug().Msg("upsert successful")
+		L.Debug().Int("written", len(written)).Msg("upsert successful")
 
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
 }
 
-var ProvideScanEntryDAO = wire.NewSet(
-	ProvideConnector,
-	wire.Struct(new(ScanEntryDAO), "*"),
-)
+func lockEntries(ctx context.Context, tx *sql.Tx, ips []string, ports []int64, services []string) (map[ScanEntryKey]*ScanEntry, error) {
+	rows, err := tx.QueryContext(ctx, lockEntriesQuery, pq.Array(ips), pq.Array(ports), pq.Array(services))
+	if err != nil {
+		return nil, fmt.Errorf("%w: locking rows failed: %w", ErrScanEntry, err)
+	}
+	defer rows.Close()
+
+	stored := map[ScanEntryKey]*ScanEntry{}
+	for rows.Next() {
+		e, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		stored[e.Key()] = &e
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: locking rows failed: %w", ErrScanEntry, err)
+	}
+	return stored, nil
+}
+
+// encoding defaults to UTF-8, for entries from data versions without any raw bytes
+func (e ScanEntry) encoding() string {
+	if e.Encoding == "" {
+		return "utf-8"
+	}
+	return e.Encoding
+}
+
+// MetadataJSON encodes the metadata as a JSON object, or an empty string if there is none
+func (e ScanEntry) MetadataJSON() string {
+	if len(e.Metadata) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(e.Metadata) // A map of strings always marshals
+	return string(data)
+}
+
+// scanEntry reads a row made of entryColumns, followed by any extra columns
+func scanEntry(rows *sql.Rows, extra ...any) (ScanEntry, error) {
+	var ip string
+	var metadata []byte
+	e := ScanEntry{}
+	dest := append([]any{&ip, &e.Port, &e.Service, &e.Updated, &e.Data, &e.Raw, &e.Encoding, &e.MessageID, &e.FirstSeen, &e.LastChanged, &e.TimesSeen, &metadata}, extra...)
+	if err := rows.Scan(dest...); err != nil {
+		return ScanEntry{}, fmt.Errorf("%w: scanning result failed: %w", ErrScanEntry, err)
+	}
+	e.IP = net.ParseIP(ip)
+	e.Updated, e.FirstSeen, e.LastChanged = localWallClock(e.Updated), localWallClock(e.FirstSeen), localWallClock(e.LastChanged)
+	if metadata != nil {
+		if err := json.Unmarshal(metadata, &e.Metadata); err != nil {
+			return ScanEntry{}, fmt.Errorf("%w: bad metadata: %w", ErrScanEntry, err)
+		}
+	}
+	return e, nil
+}
+
+// ProvideScanEntryDAO provides a DAO which records changes in the outbox only if change events are enabled, since
+// nothing would relay them otherwise
+func ProvideScanEntryDAO(dbc *DatabaseConnector, conf config.ChangesConfiguration) *ScanEntryDAO {
+	return &ScanEntryDAO{DatabaseConnector: dbc, RecordChanges: conf.Sink != ""}
+}
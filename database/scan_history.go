@@ -0,0 +1,210 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/rs/zerolog"
+)
+
+// HistoryEntry is a single past observation of a service
+type HistoryEntry struct {
+	ScanEntry
+	ContentHash []byte
+	RecordedAt  time.Time
+}
+
+// HistoryFilter narrows down a timeline; zero-valued fields do not filter anything
+type HistoryFilter struct {
+	Since time.Time
+	Until time.Time
+	Limit int
+}
+
+// ContentHash is the hash under which a response is stored in the history, computed over its exact bytes
+func ContentHash(content []byte) []byte {
+	sum := sha256.Sum256(content)
+	return sum[:]
+}
+
+const insertContentsQuery = `
+	INSERT INTO scan_contents (content_hash, data, raw, encoding)
+	SELECT hash, data, NULLIF(raw, ''::bytea), encoding FROM unnest($1::bytea[], $2::text[], $3::bytea[], $4::varchar[])
+		AS contents (hash, data, raw, encoding)
+	ON CONFLICT (content_hash) DO NOTHING
+`
+
+// Redelivered observations have the same key and timestamp, so they are skipped; only new observations are returned
+const insertHistoryQuery = `
+	INSERT INTO scan_history (ip, port, service, observed_on, content_hash)
+	SELECT * FROM unnest($1::inet[], $2::integer[], $3::varchar[], $4::timestamp[], $5::bytea[])
+	ON CONFLICT (ip, port, service, observed_on) DO NOTHING
+	RETURNING host(ip), port, service
+`
+
+const selectHistoryQuery = `
+	SELECT host(h.ip), h.port, h.service, h.observed_on, c.data, c.raw, c.encoding, h.content_hash, h.recorded_at
+	FROM scan_history h JOIN scan_contents c ON c.content_hash = h.content_hash
+`
+
+// addHistory records every given observation (stale or not) within an ongoing transaction. It returns how many
+// observations of each key were not recorded before, which is what they add to times_seen.
+func addHistory(ctx context.Context, tx *sql.Tx, entries []ScanEntry) (map[ScanEntryKey]int, error) {
+	type observation struct {
+		key      ScanEntryKey
+		observed string
+	}
+
+	observations := map[observation]string{}
+	for _, e := range entries {
+		obs := observation{e.Key(), e.Updated.Format(timestampLayout)}
+		if _, ok := observations[obs]; !ok {
+			observations[obs] = string(ContentHash(e.Content()))
+		}
+	}
+
+	if err := addContents(ctx, tx, entries); err != nil {
+		return nil, err
+	}
+
+	keys := make([]observation, 0, len(observations))
+	for obs := range observations {
+		keys = append(keys, obs)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].key != keys[j].key {
+			return keys[i].key.Less(keys[j].key)
+		}
+		return keys[i].observed < keys[j].observed
+	})
+
+	var (
+		ips      = make([]string, len(keys))
+		ports    = make([]int64, len(keys))
+		services = make([]string, len(keys))
+		observed = make([]string, len(keys))
+		obsHash  = make([][]byte, len(keys))
+	)
+	for i, obs := range keys {
+		ips[i] = obs.key.IP
+		ports[i] = int64(obs.key.Port)
+		services[i] = obs.key.Service
+		observed[i] = obs.observed
+		obsHash[i] = []byte(observations[obs])
+	}
+
+	rows, err := tx.QueryContext(ctx, insertHistoryQuery,
+		pq.Array(ips), pq.Array(ports), pq.Array(services), pq.Array(observed), pq.Array(obsHash),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: inserting history failed: %w", ErrScanEntry, err)
+	}
+	defer rows.Close()
+
+	added := map[ScanEntryKey]int{}
+	for rows.Next() {
+		var ip string
+		var key ScanEntryKey
+		if err := rows.Scan(&ip, &key.Port, &key.Service); err != nil {
+			return nil, fmt.Errorf("%w: scanning result failed: %w", ErrScanEntry, err)
+		}
+		key.IP = net.ParseIP(ip).String()
+		added[key]++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: inserting history failed: %w", ErrScanEntry, err)
+	}
+	return added, nil
+}
+
+// addContents stores the responses of the given entries within an ongoing transaction, unless they already are
+func addContents(ctx context.Context, tx *sql.Tx, entries []ScanEntry) error {
+	contents := map[string]ScanEntry{}
+	for _, e := range entries {
+		contents[string(ContentHash(e.Content()))] = e
+	}
+
+	// Sorting keeps the order rows get locked in consistent, so concurrent batches can't deadlock
+	hashes := make([]string, 0, len(contents))
+	for hash := range contents {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	hashBytes := make([][]byte, len(hashes))
+	data := make([]string, len(hashes))
+	raws := make([][]byte, len(hashes))
+	encodings := make([]string, len(hashes))
+	for i, hash := range hashes {
+		hashBytes[i] = []byte(hash)
+		data[i] = contents[hash].Data
+		raws[i] = contents[hash].Raw
+		encodings[i] = contents[hash].encoding()
+	}
+
+	_, err := tx.ExecContext(ctx, insertContentsQuery, pq.Array(hashBytes), pq.Array(data), pq.Array(raws), pq.Array(encodings))
+	if err != nil {
+		return fmt.Errorf("%w: inserting contents failed: %w", ErrScanEntry, err)
+	}
+	return nil
+}
+
+// History returns the timeline of observations of a single service, oldest first
+func (dao ScanEntryDAO) History(ctx context.Context, key ScanEntryKey, filter HistoryFilter) ([]HistoryEntry, error) {
+	clauses := []string{"h.ip = $1::inet", "h.port = $2", "h.service = $3"}
+	args := []any{key.IP, key.Port, key.Service}
+	if !filter.Since.IsZero() {
+		args = append(args, filter.Since.Format(timestampLayout))
+		clauses = append(clauses, fmt.Sprintf("h.observed_on >= $%d", len(args)))
+	}
+	if !filter.Until.IsZero() {
+		args = append(args, filter.Until.Format(timestampLayout))
+		clauses = append(clauses, fmt.Sprintf("h.observed_on < $%d", len(args)))
+	}
+	query := selectHistoryQuery + " WHERE " + strings.Join(clauses, " AND ") + " ORDER BY h.observed_on"
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	history := []HistoryEntry{}
+	err := dao.RunTransaction(ctx, &sql.TxOptions{ReadOnly: true}, func(L zerolog.Logger, tx *sql.Tx) error {
+		L = L.With().Str("action", "history").Logger()
+
+		L.Debug().Msg("running query")
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return fmt.Errorf("%w: query failed: %w", ErrScanEntry, err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			h := HistoryEntry{}
+			var ip string
+			var data sql.NullString
+			if err := rows.Scan(&ip, &h.Port, &h.Service, &h.Updated, &data, &h.Raw, &h.Encoding, &h.ContentHash, &h.RecordedAt); err != nil {
+				return fmt.Errorf("%w: scanning result failed: %w", ErrScanEntry, err)
+			}
+			h.IP = net.ParseIP(ip)
+			h.Updated = localWallClock(h.Updated)
+			h.Data = data.String
+			history = append(history, h)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("%w: query failed: %w", ErrScanEntry, err)
+		}
+
+		L.Debug().Int("count", len(history)).Msg("read history")
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return history, nil
+}
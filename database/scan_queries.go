@@ -0,0 +1,315 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+var ErrScanEntryNotFound = fmt.Errorf("%w: not found", ErrScanEntry)
+
+// EntrySort is the order entries are listed in; every order is total, so that it can be paginated over
+type EntrySort int
+
+const (
+	EntrySort_Key     EntrySort = iota // By IP, port, then service
+	EntrySort_Updated                  // By last update, then key
+)
+
+func (s EntrySort) String() string {
+	switch s {
+	case EntrySort_Key:
+		return "key"
+	case EntrySort_Updated:
+		return "updated"
+	default:
+		return "undefined"
+	}
+}
+
+func ParseEntrySort(s string) (EntrySort, error) {
+	switch strings.ToLower(s) {
+	case "", "key":
+		return EntrySort_Key, nil
+	case "updated":
+		return EntrySort_Updated, nil
+	default:
+		return EntrySort_Key, fmt.Errorf("%w: unknown sort order %q", ErrScanEntry, s)
+	}
+}
+
+// EntryCursor marks where a page of entries ended; listing again after it continues from the next entry
+type EntryCursor struct {
+	Key     ScanEntryKey
+	Updated time.Time // Only used when sorting by update time
+}
+
+// EntryCondition is an arbitrary extra condition for selecting entries, as SQL over the scan_entries columns (aliased as e)
+type EntryCondition interface {
+	// SQL renders the condition, appending its parameters to args; its placeholders are numbered after the existing ones
+	SQL(args []any) (string, []any)
+}
+
+// EntryQuery selects scan entries; zero-valued fields do not filter anything
+type EntryQuery struct {
+	IP           net.IP
+	CIDR         *net.IPNet
+	Port         uint32
+	Service      string
+	UpdatedSince time.Time // Inclusive
+	UpdatedUntil time.Time // Exclusive
+	Text         string    // Words the response must contain, in web search syntax; uses the full-text index
+	Condition    EntryCondition
+	AsOf         time.Time // Rebuild the entries as they were at this time from the history; zero for the current ones
+
+	Sort       EntrySort
+	Descending bool
+	After      *EntryCursor // Keyset pagination; nil to start from the beginning
+	Limit      int          // 0 for no limit
+}
+
+// EntryPage is one page of listed entries. Next is set if there may be more entries after it.
+type EntryPage struct {
+	Entries []ScanEntry
+	Next    *EntryCursor
+}
+
+// asOfSource rebuilds scan_entries from scan_history, as of the time in the given parameter. Message IDs and metadata are not kept
+// in the history, and the full-text vector is computed on the fly, so it is slower than the live table.
+const asOfSource = `(
+	SELECT DISTINCT ON (o.ip, o.port, o.service)
+		o.ip, o.port, o.service, o.observed_on AS updated_on, c.data, c.raw, coalesce(c.encoding, 'utf-8') AS encoding,
+		NULL::varchar AS message_id,
+		NULL::jsonb AS metadata,
+		min(o.observed_on) OVER w AS first_seen,
+		max(o.changed_on) OVER w AS last_changed,
+		(count(*) OVER w)::integer AS times_seen,
+		to_tsvector('simple', coalesce(c.data, '')) AS data_tsv
+	FROM (
+		SELECT h.ip, h.port, h.service, h.observed_on, h.content_hash,
+			CASE WHEN h.content_hash IS DISTINCT FROM lag(h.content_hash) OVER (PARTITION BY h.ip, h.port, h.service ORDER BY h.observed_on)
+				THEN h.observed_on
+			END AS changed_on
+		FROM scan_history h
+		WHERE h.observed_on <= $%d
+	) o
+	LEFT JOIN scan_contents c ON c.content_hash = o.content_hash
+	WINDOW w AS (PARTITION BY o.ip, o.port, o.service)
+	ORDER BY o.ip, o.port, o.service, o.observed_on DESC
+) e`
+
+// from is what the query selects from, aliased as e
+func (q EntryQuery) from(args []any) (string, []any) {
+	if q.AsOf.IsZero() {
+		return "scan_entries e", args
+	}
+	args = append(args, q.AsOf.Format(timestampLayout))
+	return fmt.Sprintf(asOfSource, len(args)), args
+}
+
+// sql renders the whole SELECT for the query, with the given columns
+func (q EntryQuery) sql(columns string) (string, []any) {
+	from, args := q.from(nil)
+	where, args := q.whereFrom(args)
+	return "SELECT " + columns + " FROM " + from + " WHERE " + where, args
+}
+
+// whereFrom renders the conditions after the given parameters, which are kept
+func (q EntryQuery) whereFrom(args []any) (string, []any) {
+	clauses := []string{"true"}
+	if q.IP != nil {
+		args = append(args, q.IP.String())
+		clauses = append(clauses, fmt.Sprintf("e.ip = $%d::inet", len(args)))
+	}
+	if q.CIDR != nil {
+		args = append(args, q.CIDR.String())
+		clauses = append(clauses, fmt.Sprintf("e.ip <<= $%d::inet", len(args)))
+	}
+	if q.Port != 0 {
+		args = append(args, q.Port)
+		clauses = append(clauses, fmt.Sprintf("e.port = $%d", len(args)))
+	}
+	if q.Service != "" {
+		args = append(args, q.Service)
+		clauses = append(clauses, fmt.Sprintf("e.service = $%d", len(args)))
+	}
+	if !q.UpdatedSince.IsZero() {
+		args = append(args, q.UpdatedSince.Format(timestampLayout))
+		clauses = append(clauses, fmt.Sprintf("e.updated_on >= $%d", len(args)))
+	}
+	if !q.UpdatedUntil.IsZero() {
+		args = append(args, q.UpdatedUntil.Format(timestampLayout))
+		clauses = append(clauses, fmt.Sprintf("e.updated_on < $%d", len(args)))
+	}
+
+	if q.Text != "" {
+		args = append(args, q.Text)
+		clauses = append(clauses, fmt.Sprintf("e.data_tsv @@ websearch_to_tsquery('simple', $%d)", len(args)))
+	}
+	if q.Condition != nil {
+		var clause string
+		clause, args = q.Condition.SQL(args)
+		clauses = append(clauses, "("+clause+")")
+	}
+
+	if q.After != nil {
+		// Row comparisons keep keyset pagination a single index range scan
+		columns := []string{"e.ip", "e.port", "e.service"}
+		args = append(args, q.After.Key.IP, q.After.Key.Port, q.After.Key.Service)
+		values := []string{fmt.Sprintf("$%d::inet", len(args)-2), fmt.Sprintf("$%d", len(args)-1), fmt.Sprintf("$%d", len(args))}
+		if q.Sort == EntrySort_Updated {
+			args = append(args, q.After.Updated.Format(timestampLayout))
+			columns = append([]string{"e.updated_on"}, columns...)
+			values = append([]string{fmt.Sprintf("$%d::timestamp", len(args))}, values...)
+		}
+		op := ">"
+		if q.Descending {
+			op = "<"
+		}
+		clauses = append(clauses, fmt.Sprintf("(%s) %s (%s)", strings.Join(columns, ", "), op, strings.Join(values, ", ")))
+	}
+
+	return strings.Join(clauses, " AND "), args
+}
+
+func (q EntryQuery) orderBy() string {
+	columns := []string{"e.ip", "e.port", "e.service"}
+	if q.Sort == EntrySort_Updated {
+		columns = append([]string{"e.updated_on"}, columns...)
+	}
+	if q.Descending {
+		for i := range columns {
+			columns[i] += " DESC"
+		}
+	}
+	return strings.Join(columns, ", ")
+}
+
+// GetEntry returns the stored entry with the given key, or ErrScanEntryNotFound
+func (dao ScanEntryDAO) GetEntry(ctx context.Context, key ScanEntryKey) (ScanEntry, error) {
+	ip := net.ParseIP(key.IP)
+	if ip == nil || key.Port == 0 || key.Service == "" {
+		return ScanEntry{}, fmt.Errorf("%w: incomplete key %s:%d/%s", ErrScanEntry, key.IP, key.Port, key.Service)
+	}
+
+	page, err := dao.ListEntries(ctx, EntryQuery{IP: ip, Port: key.Port, Service: key.Service, Limit: 1})
+	if err != nil {
+		return ScanEntry{}, err
+	}
+	if len(page.Entries) == 0 {
+		return ScanEntry{}, fmt.Errorf("%w: %s:%d/%s", ErrScanEntryNotFound, key.IP, key.Port, key.Service)
+	}
+	return page.Entries[0], nil
+}
+
+// ListEntries returns a page of the entries matching the query, in the requested order
+func (dao ScanEntryDAO) ListEntries(ctx context.Context, q EntryQuery) (EntryPage, error) {
+	query, args := q.sql(entryColumns)
+	query += " ORDER BY " + q.orderBy()
+	if q.Limit > 0 {
+		// One extra row tells whether there is a next page
+		args = append(args, q.Limit+1)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	page := EntryPage{Entries: []ScanEntry{}}
+	err := dao.RunTransaction(ctx, &sql.TxOptions{ReadOnly: true}, func(L zerolog.Logger, tx *sql.Tx) error {
+		L = L.With().Str("action", "listEntries").Logger()
+
+		L.Debug().Msg("running query")
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return fmt.Errorf("%w: query failed: %w", ErrScanEntry, err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			e, err := scanEntry(rows)
+			if err != nil {
+				return err
+			}
+			page.Entries = append(page.Entries, e)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("%w: query failed: %w", ErrScanEntry, err)
+		}
+
+		L.Debug().Int("count", len(page.Entries)).Msg("read entries")
+		return nil
+	})
+	if err != nil {
+		return EntryPage{}, err
+	}
+
+	if q.Limit > 0 && len(page.Entries) > q.Limit {
+		page.Entries = page.Entries[:q.Limit]
+		last := page.Entries[len(page.Entries)-1]
+		page.Next = &EntryCursor{Key: last.Key(), Updated: last.Updated}
+	}
+	return page, nil
+}
+
+// CountEntries counts the entries matching the query; its order, cursor and limit are ignored
+func (dao ScanEntryDAO) CountEntries(ctx context.Context, q EntryQuery) (int64, error) {
+	q.After = nil
+	query, args := q.sql("count(*)")
+
+	var count int64
+	err := dao.RunTransaction(ctx, &sql.TxOptions{ReadOnly: true}, func(L zerolog.Logger, tx *sql.Tx) error {
+		L = L.With().Str("action", "countEntries").Logger()
+
+		L.Debug().Msg("running query")
+		if err := tx.QueryRowContext(ctx, query, args...).Scan(&count); err != nil {
+			return fmt.Errorf("%w: query failed: %w", ErrScanEntry, err)
+		}
+
+		L.Debug().Int64("count", count).Msg("counted entries")
+		return nil
+	})
+	return count, err
+}
+
+// EachEntry streams every entry matching the query to the callback, in order, within a single read-only transaction.
+// The limit is honored, but no cursor is returned. If the callback fails, streaming stops and its error is returned.
+func (dao ScanEntryDAO) EachEntry(ctx context.Context, q EntryQuery, cb func(ScanEntry) error) error {
+	query, args := q.sql(entryColumns)
+	query += " ORDER BY " + q.orderBy()
+	if q.Limit > 0 {
+		args = append(args, q.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	return dao.RunTransaction(ctx, &sql.TxOptions{ReadOnly: true}, func(L zerolog.Logger, tx *sql.Tx) error {
+		L = L.With().Str("action", "eachEntry").Logger()
+
+		L.Debug().Msg("running query")
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return fmt.Errorf("%w: query failed: %w", ErrScanEntry, err)
+		}
+		defer rows.Close()
+
+		count := 0
+		for rows.Next() {
+			e, err := scanEntry(rows)
+			if err != nil {
+				return err
+			}
+			if err := cb(e); err != nil {
+				return err
+			}
+			count++
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("%w: query failed: %w", ErrScanEntry, err)
+		}
+
+		L.Debug().Int("count", count).Msg("streamed entries")
+		return nil
+	})
+}
@@ -0,0 +1,168 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog"
+)
+
+// Markers around the matched parts of snippets
+const (
+	HighlightStart = "<b>"
+	HighlightStop  = "</b>"
+)
+
+// snippetContext is roughly how many characters of a response are shown around a substring match
+const snippetContext = 40
+
+// SearchOptions narrows down and pages through search results. The filter's sort order and cursor are ignored, since
+// results are ordered by rank, and so is its as-of time, since only the live entries are indexed.
+type SearchOptions struct {
+	Filter EntryQuery
+	Limit  int // 0 for no limit
+	Offset int
+}
+
+// SearchResult is an entry matching a search, with how well it matched and the matching part of its response
+type SearchResult struct {
+	ScanEntry
+	Rank    float64
+	Snippet string // With matches between HighlightStart and HighlightStop
+}
+
+// searchTextQuery ranks by how densely the terms appear; the trailing key columns make the order total
+const searchTextQuery = `
+	SELECT ` + entryColumns + `,
+		ts_rank_cd(e.data_tsv, query) AS rank,
+		ts_headline('simple', e.data, query, 'StartSel=` + HighlightStart + `, StopSel=` + HighlightStop + `, MaxFragments=2, MaxWords=20, MinWords=5')
+	FROM scan_entries e, websearch_to_tsquery('simple', $1) query
+	WHERE e.data_tsv @@ query AND %s
+	ORDER BY rank DESC, e.ip, e.port, e.service
+`
+
+// searchSubstringQuery ranks by how much of the response the substring covers
+const searchSubstringQuery = `
+	SELECT ` + entryColumns + `,
+		word_similarity($1, e.data) AS rank
+	FROM scan_entries e
+	WHERE e.data ILIKE $2 AND %s
+	ORDER BY rank DESC, e.ip, e.port, e.service
+`
+
+// SearchText finds entries whose response contains the given words, using the full-text index. The text takes web
+// search syntax: "quoted phrases", or, and -excluded words.
+func (dao ScanEntryDAO) SearchText(ctx context.Context, text string, opts SearchOptions) ([]SearchResult, error) {
+	return dao.search(ctx, "searchText", searchTextQuery, []any{text}, opts, func(rows *sql.Rows) (SearchResult, error) {
+		r := SearchResult{}
+		var err error
+		r.ScanEntry, err = scanEntry(rows, &r.Rank, &r.Snippet)
+		return r, err
+	})
+}
+
+// SearchSubstring finds entries whose response contains the given string anywhere, case-insensitively, using the
+// trigram index
+func (dao ScanEntryDAO) SearchSubstring(ctx context.Context, substring string, opts SearchOptions) ([]SearchResult, error) {
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(substring) + "%"
+	return dao.search(ctx, "searchSubstring", searchSubstringQuery, []any{substring, pattern}, opts, func(rows *sql.Rows) (SearchResult, error) {
+		r := SearchResult{}
+		var err error
+		r.ScanEntry, err = scanEntry(rows, &r.Rank)
+		r.Snippet = substringSnippet(r.Data, substring)
+		return r, err
+	})
+}
+
+func (dao ScanEntryDAO) search(ctx context.Context, action string, baseQuery string, args []any, opts SearchOptions, scan func(*sql.Rows) (SearchResult, error)) ([]SearchResult, error) {
+	if strings.TrimSpace(args[0].(string)) == "" {
+		return nil, fmt.Errorf("%w: empty search", ErrScanEntry)
+	}
+
+	filter := opts.Filter
+	filter.After = nil
+	where, args := filter.whereFrom(args)
+	query := fmt.Sprintf(baseQuery, where)
+	if opts.Limit > 0 {
+		args = append(args, opts.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	if opts.Offset > 0 {
+		args = append(args, opts.Offset)
+		query += fmt.Sprintf(" OFFSET $%d", len(args))
+	}
+
+	results := []SearchResult{}
+	err := dao.RunTransaction(ctx, &sql.TxOptions{ReadOnly: true}, func(L zerolog.Logger, tx *sql.Tx) error {
+		L = L.With().Str("action", action).Logger()
+
+		L.Debug().Msg("running query")
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return fmt.Errorf("%w: query failed: %w", ErrScanEntry, err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			r, err := scan(rows)
+			if err != nil {
+				return err
+			}
+			results = append(results, r)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("%w: query failed: %w", ErrScanEntry, err)
+		}
+
+		L.Debug().Int("count", len(results)).Msg("searched entries")
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// substringSnippet cuts the part of the data around the first case-insensitive match of the substring, and highlights it
+func substringSnippet(data string, substring string) string {
+	lowerData, lowerSubstring := strings.ToLower(data), strings.ToLower(substring)
+	start := strings.Index(lowerData, lowerSubstring)
+	if start < 0 || len(lowerData) != len(data) {
+		// Lowercasing changed byte offsets, or there is no match; fall back to the start of the data
+		return truncateRunes(data, 2*snippetContext)
+	}
+	end := start + len(lowerSubstring)
+
+	from := start
+	for n := 0; from > 0 && n < snippetContext; n++ {
+		_, size := utf8.DecodeLastRuneInString(data[:from])
+		from -= size
+	}
+	to := end
+	for n := 0; to < len(data) && n < snippetContext; n++ {
+		_, size := utf8.DecodeRuneInString(data[to:])
+		to += size
+	}
+
+	snippet := data[from:start] + HighlightStart + data[start:end] + HighlightStop + data[end:to]
+	if from > 0 {
+		snippet = "…" + snippet
+	}
+	if to < len(data) {
+		snippet += "…"
+	}
+	return snippet
+}
+
+func truncateRunes(s string, n int) string {
+	for i := range s {
+		if n == 0 {
+			return s[:i] + "…"
+		}
+		n--
+	}
+	return s
+}
@@ -1,9 +1,18 @@
 package database
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"embed"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
 
 	"github.com/google/wire"
 	_ "github.com/lib/pq"
@@ -12,27 +21,198 @@ import (
 
 var ErrDatabaseSchema = errors.New("database schema")
 
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockKey identifies the advisory lock held while migrating, so concurrent migrations wait for each other
+const migrationLockKey int64 = 0x63656e737973
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
 type SchemaDAO struct {
 	*DatabaseConnector
 }
 
-const createSchemaSQL = `
-	CREATE TABLE IF NOT EXISTS scan_entries (
-		ip inet NOT NULL,
-		port integer NOT NULL,
-		service varchar NOT NULL,
-		updated_on timestamp without time zone NOT NULL,
-		data text,
-		PRIMARY KEY (ip, port, service)
+// Migration is a single, versioned step of the schema; Checksum covers the "up" SQL
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+type MigrationStatus struct {
+	Migration
+	Applied          bool
+	AppliedAt        time.Time
+	ChecksumMismatch bool // Applied, but with different SQL than this build has
+	Unknown          bool // Applied, but not part of this build (the database is newer)
+}
+
+const createMigrationsTableSQL = `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version integer PRIMARY KEY,
+		name varchar NOT NULL,
+		checksum varchar NOT NULL,
+		applied_at timestamp with time zone NOT NULL DEFAULT now()
 	)
 `
 
-func (dsm SchemaDAO) InitializeSchema() error {
-	return dsm.RunTransaction(nil, func(L zerolog.Logger, tx *sql.Tx) error {
-		L = L.With().Str("action", "initSchema").Logger()
-		L.Debug().Msg("run schema init query")
-		if _, err := tx.ExecContext(dsm.Context, createSchemaSQL); err != nil {
-			return fmt.Errorf("%w: query failed (%w)", ErrDatabaseSchema, err)
+// Migrations lists the migrations embedded in this build, in version order
+func Migrations() ([]Migration, error) {
+	files, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not list migrations: %w", ErrDatabaseSchema, err)
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, f := range files {
+		match := migrationFileName.FindStringSubmatch(f.Name())
+		if match == nil {
+			return nil, fmt.Errorf("%w: badly named migration file (%s)", ErrDatabaseSchema, f.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		content, err := migrationFiles.ReadFile("migrations/" + f.Name())
+		if err != nil {
+			return nil, fmt.Errorf("%w: could not read migration (%s): %w", ErrDatabaseSchema, f.Name(), err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("%w: migration %d has files with different names", ErrDatabaseSchema, version)
+		}
+		if match[3] == "up" {
+			m.Up = string(content)
+			sum := sha256.Sum256(content)
+			m.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := []Migration{}
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("%w: migration %d needs both an up and a down file", ErrDatabaseSchema, m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// LatestVersion is the version the schema ends up at after applying all migrations of this build
+func LatestVersion() (int, error) {
+	migrations, err := Migrations()
+	if err != nil || len(migrations) == 0 {
+		return 0, err
+	}
+	return migrations[len(migrations)-1].Version, nil
+}
+
+// InitializeSchema applies all pending migrations
+func (dsm SchemaDAO) InitializeSchema(ctx context.Context) error {
+	latest, err := LatestVersion()
+	if err != nil {
+		return err
+	}
+	return dsm.MigrateTo(ctx, latest)
+}
+
+// MigrateTo applies or rolls back migrations until the schema is at the target version (0 meaning no migrations at all).
+// Everything happens in one transaction, under an advisory lock, so it either fully succeeds or changes nothing.
+func (dsm SchemaDAO) MigrateTo(ctx context.Context, target int) error {
+	migrations, err := Migrations()
+	if err != nil {
+		return err
+	}
+	if target != 0 && !hasMigration(migrations, target) {
+		return fmt.Errorf("%w: no migration with version %d", ErrDatabaseSchema, target)
+	}
+	return dsm.migrate(ctx, migrations, func([]MigrationStatus) int { return target })
+}
+
+// MigrateDown rolls back the given number of most recently applied migrations
+func (dsm SchemaDAO) MigrateDown(ctx context.Context, steps int) error {
+	migrations, err := Migrations()
+	if err != nil {
+		return err
+	}
+
+	// The target depends on what is applied, so it is picked under the lock, where no one else can change that
+	return dsm.migrate(ctx, migrations, func(statuses []MigrationStatus) int {
+		applied := []int{}
+		for _, st := range statuses {
+			if st.Applied {
+				applied = append(applied, st.Version)
+			}
+		}
+		if steps > len(applied) {
+			steps = len(applied)
+		}
+		if remaining := len(applied) - steps; remaining > 0 {
+			return applied[remaining-1]
+		}
+		return 0
+	})
+}
+
+// migrate moves the schema to the version picked by target, given the current statuses, within a single transaction
+// holding the migration lock
+func (dsm SchemaDAO) migrate(ctx context.Context, migrations []Migration, target func([]MigrationStatus) int) error {
+	return dsm.RunTransaction(ctx, nil, func(L zerolog.Logger, tx *sql.Tx) error {
+		L = L.With().Str("action", "migrate").Logger()
+
+		if err := lockMigrations(ctx, L, tx); err != nil {
+			return err
+		}
+
+		statuses, err := migrationStatuses(ctx, tx, migrations)
+		if err != nil {
+			return err
+		}
+		target := target(statuses)
+		L = L.With().Int("target", target).Logger()
+		for _, st := range statuses {
+			if st.Unknown {
+				return fmt.Errorf("%w: database has migration %d (%s), which this build does not know about", ErrDatabaseSchema, st.Version, st.Name)
+			}
+			if st.ChecksumMismatch {
+				return fmt.Errorf("%w: migration %d (%s) was applied with different SQL than this build has", ErrDatabaseSchema, st.Version, st.Name)
+			}
+		}
+
+		for _, st := range statuses {
+			if st.Applied || st.Version > target {
+				continue
+			}
+			L.Info().Int("version", st.Version).Str("name", st.Name).Msg("applying migration")
+			if _, err := tx.ExecContext(ctx, st.Up); err != nil {
+				return fmt.Errorf("%w: migration %d (%s) failed: %w", ErrDatabaseSchema, st.Version, st.Name, err)
+			}
+			_, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)", st.Version, st.Name, st.Checksum)
+			if err != nil {
+				return fmt.Errorf("%w: recording migration %d failed: %w", ErrDatabaseSchema, st.Version, err)
+			}
+		}
+
+		for i := len(statuses) - 1; i >= 0; i-- {
+			st := statuses[i]
+			if !st.Applied || st.Version <= target {
+				continue
+			}
+			L.Info().Int("version", st.Version).Str("name", st.Name).Msg("rolling back migration")
+			if _, err := tx.ExecContext(ctx, st.Down); err != nil {
+				return fmt.Errorf("%w: rolling back migration %d (%s) failed: %w", ErrDatabaseSchema, st.Version, st.Name, err)
+			}
+			if _, err := tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = $1", st.Version); err != nil {
+				return fmt.Errorf("%w: unrecording migration %d failed: %w", ErrDatabaseSchema, st.Version, err)
+			}
 		}
 
 		L.Debug().Msg("commiting")
@@ -40,12 +220,97 @@ func (dsm SchemaDAO) InitializeSchema() error {
 			return fmt.Errorf("%w: commit failed: %w", ErrDatabaseSchema, err)
 		}
 
-		L.Debug().Msg("schema init successful")
+		L.Info().Msg("migration successful")
 		return nil
 	})
 }
 
-var ProvideSchemaDAO = wire.NewSet(
-	wire.Struct(new(SchemaDAO), "*"),
-	ProvideConnector,
-)
+// Status lists every migration, whether part of this build or applied to the database, in version order
+func (dsm SchemaDAO) Status(ctx context.Context) ([]MigrationStatus, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []MigrationStatus
+	err = dsm.RunTransaction(ctx, nil, func(L zerolog.Logger, tx *sql.Tx) error {
+		L = L.With().Str("action", "migrationStatus").Logger()
+
+		// Don't read a migration halfway through
+		if err := lockMigrations(ctx, L, tx); err != nil {
+			return err
+		}
+
+		L.Debug().Msg("reading applied migrations")
+		statuses, err = migrationStatuses(ctx, tx, migrations)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	return statuses, err
+}
+
+// lockMigrations takes the migration lock, until the end of the transaction
+func lockMigrations(ctx context.Context, L zerolog.Logger, tx *sql.Tx) error {
+	L.Debug().Msg("waiting for migration lock")
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", migrationLockKey); err != nil {
+		return fmt.Errorf("%w: could not lock for migration: %w", ErrDatabaseSchema, err)
+	}
+	return nil
+}
+
+func migrationStatuses(ctx context.Context, tx *sql.Tx, migrations []Migration) ([]MigrationStatus, error) {
+	if _, err := tx.ExecContext(ctx, createMigrationsTableSQL); err != nil {
+		return nil, fmt.Errorf("%w: could not create migrations table: %w", ErrDatabaseSchema, err)
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT version, name, checksum, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not read applied migrations: %w", ErrDatabaseSchema, err)
+	}
+	defer rows.Close()
+
+	byVersion := map[int]*MigrationStatus{}
+	for _, m := range migrations {
+		byVersion[m.Version] = &MigrationStatus{Migration: m}
+	}
+	for rows.Next() {
+		var version int
+		var name, checksum string
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &name, &checksum, &appliedAt); err != nil {
+			return nil, fmt.Errorf("%w: could not read applied migrations: %w", ErrDatabaseSchema, err)
+		}
+
+		st, ok := byVersion[version]
+		if !ok {
+			st = &MigrationStatus{Migration: Migration{Version: version, Name: name, Checksum: checksum}, Unknown: true}
+			byVersion[version] = st
+		}
+		st.Applied = true
+		st.AppliedAt = appliedAt
+		st.ChecksumMismatch = !st.Unknown && st.Checksum != checksum
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: could not read applied migrations: %w", ErrDatabaseSchema, err)
+	}
+
+	statuses := make([]MigrationStatus, 0, len(byVersion))
+	for _, st := range byVersion {
+		statuses = append(statuses, *st)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
+
+func hasMigration(migrations []Migration, version int) bool {
+	for _, m := range migrations {
+		if m.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+var ProvideSchemaDAO = wire.Struct(new(SchemaDAO), "*")
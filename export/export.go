@@ -0,0 +1,198 @@
+package export
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsufitch/censys-takehome/database"
+	"github.com/fsufitch/censys-takehome/logging"
+	"github.com/google/wire"
+)
+
+var ErrExport = errors.New("export")
+
+// ManifestName is the name of the manifest file written next to the exported files
+const ManifestName = "manifest.json"
+
+// Options describe a single export
+type Options struct {
+	Dir          string // Where to write the files and manifest; created if missing
+	Prefix       string // Start of every file name, followed by a sequence number and the extension
+	Format       string
+	Compression  string
+	MaxFileBytes int64 // Start a new file once one reaches this size (roughly; compressors and row groups buffer); 0 for a single file
+	Query        database.EntryQuery
+}
+
+// Manifest lists what an export produced, so that consumers can check they got all of it
+type Manifest struct {
+	CreatedAt   time.Time      `json:"created_at"`
+	AsOf        *time.Time     `json:"as_of,omitempty"`
+	Format      string         `json:"format"`
+	Compression string         `json:"compression"`
+	Rows        int64          `json:"rows"`
+	Files       []ManifestFile `json:"files"`
+}
+
+type ManifestFile struct {
+	Name   string `json:"name"`
+	Rows   int64  `json:"rows"`
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256"`
+}
+
+// Exporter streams scan entries into files for other teams to consume
+type Exporter struct {
+	Context      context.Context
+	Log          logging.LogFunc
+	ScanEntryDAO *database.ScanEntryDAO
+}
+
+// outputFile is an exported file being written, keeping track of its size and checksum
+type outputFile struct {
+	file    *os.File
+	hash    hash.Hash
+	rows    int64
+	bytes   int64
+	name    string
+	encoder rowWriter
+}
+
+func (o *outputFile) Write(p []byte) (int, error) {
+	n, err := o.file.Write(p)
+	o.hash.Write(p[:n])
+	o.bytes += int64(n)
+	return n, err
+}
+
+// Run exports every entry matching the query, then writes the manifest. The manifest is only written if everything
+// else succeeded, so its presence marks a complete export.
+func (ex Exporter) Run(opts Options) (Manifest, error) {
+	if err := checkFormat(opts.Format, opts.Compression); err != nil {
+		return Manifest{}, err
+	}
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return Manifest{}, fmt.Errorf("%w: %w", ErrExport, err)
+	}
+
+	L := ex.Log().With().Str("dir", opts.Dir).Str("format", opts.Format).Str("compression", opts.Compression).Logger()
+	manifest := Manifest{
+		CreatedAt:   time.Now(),
+		Format:      opts.Format,
+		Compression: opts.Compression,
+		Files:       []ManifestFile{},
+	}
+	if !opts.Query.AsOf.IsZero() {
+		asOf := opts.Query.AsOf
+		manifest.AsOf = &asOf
+	}
+
+	var current *outputFile
+	closeCurrent := func() error {
+		if current == nil {
+			return nil
+		}
+		defer func() { current = nil }()
+		if err := current.encoder.Close(); err != nil {
+			current.file.Close()
+			return err
+		}
+		if err := current.file.Sync(); err != nil {
+			current.file.Close()
+			return fmt.Errorf("%w: %w", ErrExport, err)
+		}
+		if err := current.file.Close(); err != nil {
+			return fmt.Errorf("%w: %w", ErrExport, err)
+		}
+		manifest.Files = append(manifest.Files, ManifestFile{
+			Name:   current.name,
+			Rows:   current.rows,
+			Bytes:  current.bytes,
+			SHA256: hex.EncodeToString(current.hash.Sum(nil)),
+		})
+		L.Info().Str("file", current.name).Int64("rows", current.rows).Int64("bytes", current.bytes).Msg("finished file")
+		return nil
+	}
+	openNext := func() error {
+		name := fmt.Sprintf("%s-%05d%s", opts.Prefix, len(manifest.Files)+1, Extension(opts.Format, opts.Compression))
+		f, err := os.Create(filepath.Join(opts.Dir, name))
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrExport, err)
+		}
+		current = &outputFile{file: f, hash: sha256.New(), name: name}
+		if current.encoder, err = newRowWriter(opts.Format, opts.Compression, current); err != nil {
+			f.Close()
+			return err
+		}
+		return nil
+	}
+
+	err := ex.ScanEntryDAO.EachEntry(ex.Context, opts.Query, func(e database.ScanEntry) error {
+		if current == nil {
+			if err := openNext(); err != nil {
+				return err
+			}
+		}
+		if err := current.encoder.Write(NewRow(e)); err != nil {
+			return err
+		}
+		current.rows++
+		manifest.Rows++
+
+		if opts.MaxFileBytes > 0 && current.encoder.Flushed() && current.bytes >= opts.MaxFileBytes {
+			return closeCurrent()
+		}
+		return nil
+	})
+	if err == nil && current == nil && len(manifest.Files) == 0 {
+		// Nothing matched; still produce a (valid, empty) file, so consumers don't have to special-case it
+		err = openNext()
+	}
+	if closeErr := closeCurrent(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return manifest, err
+	}
+
+	if err := writeManifest(filepath.Join(opts.Dir, ManifestName), manifest); err != nil {
+		return manifest, err
+	}
+	L.Info().Int64("rows", manifest.Rows).Int("files", len(manifest.Files)).Msg("export complete")
+	return manifest, nil
+}
+
+// writeManifest replaces the manifest atomically, so it is never seen half-written
+func writeManifest(path string, manifest Manifest) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".manifest-*")
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrExport, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	enc := json.NewEncoder(tmp)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		tmp.Close()
+		return fmt.Errorf("%w: %w", ErrExport, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("%w: %w", ErrExport, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("%w: %w", ErrExport, err)
+	}
+	return nil
+}
+
+var ProvideExporter = wire.NewSet(
+	wire.Struct(new(Exporter), "*"),
+)
@@ -0,0 +1,234 @@
+package export
+
+import (
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/fsufitch/censys-takehome/database"
+	"github.com/klauspost/compress/zstd"
+	"github.com/parquet-go/parquet-go"
+	parquetgzip "github.com/parquet-go/parquet-go/compress/gzip"
+	parquetzstd "github.com/parquet-go/parquet-go/compress/zstd"
+)
+
+// Formats and compressions, as configured
+const (
+	Format_NDJSON  = "ndjson"
+	Format_CSV     = "csv"
+	Format_Parquet = "parquet"
+
+	Compression_None = "none"
+	Compression_Gzip = "gzip"
+	Compression_Zstd = "zstd"
+)
+
+// parquetRowGroupSize is how many rows go in each Parquet row group; files are only rotated between row groups
+const parquetRowGroupSize = 10000
+
+// Row is an exported scan entry
+type Row struct {
+	IP          string            `json:"ip" parquet:"ip"`
+	Port        int32             `json:"port" parquet:"port"`
+	Service     string            `json:"service" parquet:"service"`
+	Updated     time.Time         `json:"updated" parquet:"updated,timestamp(microsecond)"`
+	Data        string            `json:"data" parquet:"data"`
+	Encoding    string            `json:"encoding" parquet:"encoding"`
+	Raw         []byte            `json:"raw,omitempty" parquet:"raw,optional"` // Only if data is not the exact response
+	MessageID   string            `json:"message_id" parquet:"message_id"`
+	Metadata    map[string]string `json:"metadata,omitempty" parquet:"metadata,optional"`
+	FirstSeen   time.Time         `json:"first_seen" parquet:"first_seen,timestamp(microsecond)"`
+	LastChanged time.Time         `json:"last_changed" parquet:"last_changed,timestamp(microsecond)"`
+	TimesSeen   int32             `json:"times_seen" parquet:"times_seen"`
+}
+
+// CSVHeader names the columns of CSVRecord
+var CSVHeader = []string{"ip", "port", "service", "updated", "data", "encoding", "raw_base64", "message_id", "metadata", "first_seen", "last_changed", "times_seen"}
+
+func NewRow(e database.ScanEntry) Row {
+	return Row{
+		IP:          e.IP.String(),
+		Port:        int32(e.Port),
+		Service:     e.Service,
+		Updated:     e.Updated,
+		Data:        e.Data,
+		Encoding:    e.Encoding,
+		Raw:         e.Raw,
+		MessageID:   e.MessageID,
+		Metadata:    e.Metadata,
+		FirstSeen:   e.FirstSeen,
+		LastChanged: e.LastChanged,
+		TimesSeen:   int32(e.TimesSeen),
+	}
+}
+
+// CSVRecord lays out a row as CSV columns, in the order of CSVHeader
+func (r Row) CSVRecord() []string {
+	return []string{
+		r.IP, strconv.Itoa(int(r.Port)), r.Service, r.Updated.Format(time.RFC3339), r.Data,
+		r.Encoding, base64.StdEncoding.EncodeToString(r.Raw), r.MessageID, metadataJSON(r.Metadata),
+		r.FirstSeen.Format(time.RFC3339), r.LastChanged.Format(time.RFC3339), strconv.Itoa(int(r.TimesSeen)),
+	}
+}
+
+// rowWriter encodes rows into a single output file
+type rowWriter interface {
+	Write(Row) error
+	// Flushed says whether everything written so far has reached the file, so its size can be checked
+	Flushed() bool
+	// Close finishes the encoding (and compression), but leaves the file itself open
+	Close() error
+}
+
+// Extension is the file name extension for a format and compression
+func Extension(format string, compression string) string {
+	if format == Format_Parquet {
+		return ".parquet"
+	}
+	switch compression {
+	case Compression_Gzip:
+		return "." + format + ".gz"
+	case Compression_Zstd:
+		return "." + format + ".zst"
+	default:
+		return "." + format
+	}
+}
+
+// checkFormat makes sure a format and compression are supported, before any file gets created
+func checkFormat(format string, compression string) error {
+	switch format {
+	case Format_NDJSON, Format_CSV, Format_Parquet:
+	default:
+		return fmt.Errorf("%w: unknown format %q (expected ndjson, csv or parquet)", ErrExport, format)
+	}
+	switch compression {
+	case Compression_None, Compression_Gzip, Compression_Zstd:
+	default:
+		return fmt.Errorf("%w: unknown compression %q (expected none, gzip or zstd)", ErrExport, compression)
+	}
+	return nil
+}
+
+func newRowWriter(format string, compression string, w io.Writer) (rowWriter, error) {
+	if format == Format_Parquet {
+		// Parquet compresses its own pages
+		options := []parquet.WriterOption{}
+		switch compression {
+		case Compression_Gzip:
+			options = append(options, parquet.Compression(&parquetgzip.Codec{}))
+		case Compression_Zstd:
+			options = append(options, parquet.Compression(&parquetzstd.Codec{}))
+		}
+		return &parquetRowWriter{w: parquet.NewGenericWriter[Row](w, options...), flushed: true}, nil
+	}
+
+	var compressor io.WriteCloser
+	switch compression {
+	case Compression_Gzip:
+		compressor = gzip.NewWriter(w)
+	case Compression_Zstd:
+		enc, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrExport, err)
+		}
+		compressor = enc
+	default:
+		compressor = nopCloser{w}
+	}
+
+	switch format {
+	case Format_NDJSON:
+		enc := json.NewEncoder(compressor)
+		return &textRowWriter{compressor: compressor, write: func(r Row) error { return enc.Encode(r) }}, nil
+	case Format_CSV:
+		cw := csv.NewWriter(compressor)
+		if err := cw.Write(CSVHeader); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrExport, err)
+		}
+		return &textRowWriter{
+			compressor: compressor,
+			write:      func(r Row) error { return cw.Write(r.CSVRecord()) },
+			flush: func() error {
+				cw.Flush()
+				return cw.Error()
+			},
+		}, nil
+	}
+	return nil, fmt.Errorf("%w: unknown format %q", ErrExport, format)
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// textRowWriter writes line-based formats; the compressor (if any) only ever holds back a block, so its output is
+// close enough to tell the file size by
+type textRowWriter struct {
+	compressor io.WriteCloser
+	write      func(Row) error
+	flush      func() error // Optional
+}
+
+func (t *textRowWriter) Write(r Row) error {
+	if err := t.write(r); err != nil {
+		return fmt.Errorf("%w: %w", ErrExport, err)
+	}
+	return nil
+}
+
+func (t *textRowWriter) Flushed() bool { return true }
+
+func (t *textRowWriter) Close() error {
+	if t.flush != nil {
+		if err := t.flush(); err != nil {
+			return fmt.Errorf("%w: %w", ErrExport, err)
+		}
+	}
+	if err := t.compressor.Close(); err != nil {
+		return fmt.Errorf("%w: %w", ErrExport, err)
+	}
+	return nil
+}
+
+// parquetRowWriter buffers rows into row groups, which are only written out once complete
+type parquetRowWriter struct {
+	w       *parquet.GenericWriter[Row]
+	pending int
+	flushed bool
+}
+
+func (p *parquetRowWriter) Write(r Row) error {
+	if _, err := p.w.Write([]Row{r}); err != nil {
+		return fmt.Errorf("%w: %w", ErrExport, err)
+	}
+	p.pending++
+	p.flushed = false
+	if p.pending >= parquetRowGroupSize {
+		if err := p.w.Flush(); err != nil {
+			return fmt.Errorf("%w: %w", ErrExport, err)
+		}
+		p.pending = 0
+		p.flushed = true
+	}
+	return nil
+}
+
+func (p *parquetRowWriter) Flushed() bool { return p.flushed }
+
+func (p *parquetRowWriter) Close() error {
+	if err := p.w.Close(); err != nil {
+		return fmt.Errorf("%w: %w", ErrExport, err)
+	}
+	return nil
+}
+
+// metadataJSON encodes metadata for CSV, as a JSON object or an empty string if there is none
+func metadataJSON(metadata map[string]string) string {
+	return database.ScanEntry{Metadata: metadata}.MetadataJSON()
+}
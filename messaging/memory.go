@@ -0,0 +1,69 @@
+package messaging
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// MemoryMessage is a message that only exists in memory; acking and nacking it just calls the given callbacks
+type MemoryMessage struct {
+	MessageID         string
+	Payload           []byte
+	MessageAttributes map[string]string
+	Attempt           int
+	OnAck             func()
+	OnNack            func()
+}
+
+func (m *MemoryMessage) ID() string                    { return m.MessageID }
+func (m *MemoryMessage) Data() []byte                  { return m.Payload }
+func (m *MemoryMessage) Attributes() map[string]string { return m.MessageAttributes }
+func (m *MemoryMessage) DeliveryAttempt() int          { return m.Attempt }
+
+func (m *MemoryMessage) Ack() {
+	if m.OnAck != nil {
+		m.OnAck()
+	}
+}
+
+func (m *MemoryMessage) Nack() {
+	if m.OnNack != nil {
+		m.OnNack()
+	}
+}
+
+// ChannelSource delivers whatever messages are sent on its channel, which makes it usable without any external service
+type ChannelSource struct {
+	Messages <-chan Message
+
+	receiving atomic.Bool
+}
+
+// Receive runs until the channel is closed (and all handlers returned) or the context is done
+func (src *ChannelSource) Receive(ctx context.Context, handler Handler) error {
+	src.receiving.Store(true)
+	defer src.receiving.Store(false)
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg, ok := <-src.Messages:
+			if !ok {
+				return nil
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				handler(ctx, msg)
+			}()
+		}
+	}
+}
+
+func (src *ChannelSource) Receiving() bool {
+	return src.receiving.Load()
+}
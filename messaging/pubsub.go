@@ -0,0 +1,120 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/fsufitch/censys-takehome/config"
+	"github.com/fsufitch/censys-takehome/logging"
+	"github.com/google/wire"
+)
+
+func ProvidePubsubClient(ctx context.Context, conf config.PubsubConfiguration, logFunc logging.LogFunc) (*pubsub.Client, func(), error) {
+	logFunc().Debug().Str("project", conf.ProjectID).Msg("connecting to pubsub")
+	client, err := pubsub.NewClient(ctx, conf.ProjectID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: failed connecting to pubsub (%s): %w", ErrSource, conf.ProjectID, err)
+	}
+
+	cleanup := func() {
+		logFunc().Info().Msg("cleaning up pubsub client")
+		if err := client.Close(); err != nil {
+			logFunc().Err(err).Msg("error closing pubsub client")
+		}
+	}
+	return client, cleanup, nil
+}
+
+// PubsubSource receives messages from a Pubsub subscription
+type PubsubSource struct {
+	Config config.PubsubConfiguration
+	Log    logging.LogFunc
+	Client *pubsub.Client
+
+	receiving atomic.Bool
+}
+
+func (src *PubsubSource) Receive(ctx context.Context, handler Handler) error {
+	if d := src.Config.AckDeadline; d != 0 && (d < 10*time.Second || d > 10*time.Minute) {
+		return fmt.Errorf("%w: ack deadline must be between 10s and 10m, not %s", ErrSource, d)
+	}
+
+	src.Log().Debug().Msg("getting subscription")
+	subscription := src.Client.Subscription(src.Config.SubscriptionID)
+	if exists, err := subscription.Exists(ctx); !exists || err != nil {
+		return fmt.Errorf("%w: subscription does not exist (%s): %w", ErrSource, src.Config.SubscriptionID, err)
+	}
+
+	subscription.ReceiveSettings = src.receiveSettings()
+	src.Log().Info().
+		Int("maxOutstandingMessages", subscription.ReceiveSettings.MaxOutstandingMessages).
+		Int("maxOutstandingBytes", subscription.ReceiveSettings.MaxOutstandingBytes).
+		Int("numGoroutines", subscription.ReceiveSettings.NumGoroutines).
+		Dur("maxExtension", subscription.ReceiveSettings.MaxExtension).
+		Dur("ackDeadline", src.Config.AckDeadline).
+		Msg("receiving from subscription")
+
+	src.receiving.Store(true)
+	defer src.receiving.Store(false)
+
+	err := subscription.Receive(ctx, func(msgContext context.Context, msg *pubsub.Message) {
+		handler(msgContext, pubsubMessage{msg})
+	})
+	if err != nil {
+		return fmt.Errorf("%w: receive failed (%s): %w", ErrSource, src.Config.SubscriptionID, err)
+	}
+	return nil
+}
+
+// receiveSettings applies the configuration over the library defaults
+func (src *PubsubSource) receiveSettings() pubsub.ReceiveSettings {
+	settings := pubsub.DefaultReceiveSettings
+	if src.Config.MaxOutstandingMessages != 0 {
+		settings.MaxOutstandingMessages = src.Config.MaxOutstandingMessages
+	}
+	if src.Config.MaxOutstandingBytes != 0 {
+		settings.MaxOutstandingBytes = src.Config.MaxOutstandingBytes
+	}
+	if src.Config.NumGoroutines != 0 {
+		settings.NumGoroutines = src.Config.NumGoroutines
+	}
+	if src.Config.MaxExtension != 0 {
+		settings.MaxExtension = src.Config.MaxExtension
+	}
+	if src.Config.AckDeadline != 0 {
+		// Pinning both bounds of the extension period makes every lease extension ask for exactly this deadline
+		settings.MinExtensionPeriod = src.Config.AckDeadline
+		settings.MaxExtensionPeriod = src.Config.AckDeadline
+	}
+	return settings
+}
+
+func (src *PubsubSource) Receiving() bool {
+	return src.receiving.Load()
+}
+
+type pubsubMessage struct {
+	msg *pubsub.Message
+}
+
+func (m pubsubMessage) ID() string                    { return m.msg.ID }
+func (m pubsubMessage) Data() []byte                  { return m.msg.Data }
+func (m pubsubMessage) Attributes() map[string]string { return m.msg.Attributes }
+func (m pubsubMessage) Ack()                          { m.msg.Ack() }
+func (m pubsubMessage) Nack()                         { m.msg.Nack() }
+
+func (m pubsubMessage) DeliveryAttempt() int {
+	if m.msg.DeliveryAttempt == nil {
+		return 0
+	}
+	return *m.msg.DeliveryAttempt
+}
+
+var ProvidePubsubSource = wire.NewSet(
+	ProvidePubsubClient,
+	wire.Struct(new(PubsubSource), "Config", "Log", "Client"),
+	wire.Bind(new(MessageSource), new(*PubsubSource)),
+)
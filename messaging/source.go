@@ -0,0 +1,29 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrSource = errors.New("message source")
+
+// Message is a single delivery from a MessageSource; it must be acked or nacked exactly once
+type Message interface {
+	ID() string
+	Data() []byte
+	Attributes() map[string]string
+	DeliveryAttempt() int // 0 if the source does not keep track of attempts
+	Ack()
+	Nack()
+}
+
+// Handler processes one message. It may return before the message is acked or nacked.
+type Handler func(context.Context, Message)
+
+type MessageSource interface {
+	// Receive calls the handler (possibly concurrently) for each message, until the context is done or the source fails
+	Receive(ctx context.Context, handler Handler) error
+
+	// Receiving reports whether Receive is currently up and delivering messages
+	Receiving() bool
+}
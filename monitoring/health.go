@@ -0,0 +1,69 @@
+package monitoring
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/fsufitch/censys-takehome/database"
+	"github.com/fsufitch/censys-takehome/messaging"
+)
+
+// readinessTimeout bounds how long any single readiness check may take
+const readinessTimeout = 2 * time.Second
+
+// ReadinessCheck returns nil if the part of the process it looks at is able to do its job
+type ReadinessCheck struct {
+	Name  string
+	Check func(context.Context) error
+}
+
+type ReadinessChecks []ReadinessCheck
+
+func ProvideReadinessChecks(dbc *database.DatabaseConnector, source messaging.MessageSource, breaker *database.CircuitBreaker) ReadinessChecks {
+	return ReadinessChecks{
+		{Name: "database", Check: dbc.Ping},
+		{Name: "circuit_breaker", Check: breaker.Check},
+		{Name: "subscription", Check: func(context.Context) error {
+			if !source.Receiving() {
+				return errors.New("not receiving messages")
+			}
+			return nil
+		}},
+	}
+}
+
+type readinessResponse struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+func (srv *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok\n"))
+}
+
+func (srv *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	response := readinessResponse{Ready: true, Checks: map[string]string{}}
+	for _, check := range srv.Readiness {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		err := check.Check(ctx)
+		cancel()
+
+		if err != nil {
+			response.Ready = false
+			response.Checks[check.Name] = err.Error()
+			srv.Log().Debug().Err(err).Str("check", check.Name).Msg("readiness check failed")
+		} else {
+			response.Checks[check.Name] = "ok"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !response.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,133 @@
+package monitoring
+
+import (
+	"github.com/fsufitch/censys-takehome/database"
+	"github.com/fsufitch/censys-takehome/spool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+const namespace = "censys_takehome"
+
+// Metrics holds every Prometheus collector of the processor, registered on its own registry
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	MessagesReceived *prometheus.CounterVec // By data version
+	MessagesAcked    *prometheus.CounterVec // By result (inserted, updated, stale, dead_lettered)
+	MessagesNacked   *prometheus.CounterVec // By reason
+	MessagesRejected *prometheus.CounterVec // By reason (dead letter error class) and data version
+	ChangeEvents     *prometheus.CounterVec // By result (emitted, failed)
+
+	DecodeDuration prometheus.Histogram
+	UpsertDuration prometheus.Histogram // Per batch
+	BatchSize      prometheus.Histogram
+	ScanLag        prometheus.Histogram // Time from the scan happening to it being recorded
+
+	FlowLimit        prometheus.Gauge // Messages the flow control lets through at once
+	MessagesInFlight prometheus.Gauge // Messages let through by the flow control, not yet acked or nacked
+}
+
+func ProvideMetrics(dbc *database.DatabaseConnector, sp *spool.Spool, breaker *database.CircuitBreaker) *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+
+		MessagesReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "processor", Name: "messages_received_total",
+			Help: "Messages received, by data version (0 if it could not be determined).",
+		}, []string{"data_version"}),
+		MessagesAcked: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "processor", Name: "messages_acked_total",
+			Help: "Messages acknowledged, by what happened to them.",
+		}, []string{"result"}),
+		MessagesNacked: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "processor", Name: "messages_nacked_total",
+			Help: "Messages negatively acknowledged (to be redelivered), by reason.",
+		}, []string{"reason"}),
+		MessagesRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "processor", Name: "messages_rejected_total",
+			Help: "Messages which could not be decoded or validated, by reason and data version.",
+		}, []string{"reason", "data_version"}),
+		ChangeEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "processor", Name: "change_events_total",
+			Help: "Change events for services whose response changed, by whether they were emitted.",
+		}, []string{"result"}),
+
+		DecodeDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: "processor", Name: "decode_duration_seconds",
+			Help:    "Time spent decoding and validating a message.",
+			Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}),
+		UpsertDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: "database", Name: "upsert_duration_seconds",
+			Help:    "Time spent writing a batch of entries to the database.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		BatchSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: "database", Name: "upsert_batch_size",
+			Help:    "Number of entries written per batch.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+		}),
+		ScanLag: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: "processor", Name: "scan_lag_seconds",
+			Help:    "Time between a scan's timestamp and the processor recording it.",
+			Buckets: prometheus.ExponentialBuckets(0.1, 3, 12),
+		}),
+
+		FlowLimit: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "processor", Name: "flow_limit",
+			Help: "Messages the adaptive flow control currently lets through at once.",
+		}),
+		MessagesInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "processor", Name: "messages_in_flight",
+			Help: "Messages let through by the adaptive flow control which are not acked or nacked yet.",
+		}),
+	}
+
+	m.Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+
+		m.MessagesReceived, m.MessagesAcked, m.MessagesNacked, m.MessagesRejected, m.ChangeEvents,
+		m.DecodeDuration, m.UpsertDuration, m.BatchSize, m.ScanLag,
+		m.FlowLimit, m.MessagesInFlight,
+
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "database", Name: "connected",
+			Help: "Whether the database looks available (1) or not (0): the connector has a connection, and the circuit breaker is not open.",
+		}, func() float64 {
+			// The connector only notices a connection is gone when reconnecting, so the breaker (opened by failing
+			// writes) is what catches outages after startup
+			if dbc.Connected() && breaker.State() != database.BreakerState_Open {
+				return 1
+			}
+			return 0
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "database", Name: "connect_attempts_total",
+			Help: "Connection attempts made by the database connector, successful or not.",
+		}, func() float64 {
+			return float64(dbc.ConnectAttempts())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "database", Name: "circuit_breaker_state",
+			Help: "State of the circuit breaker around database writes: closed (0), half-open (1) or open (2).",
+		}, func() float64 {
+			return float64(breaker.State())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "spool", Name: "entries",
+			Help: "Entries spooled to disk while the database was unavailable, waiting to be written to it.",
+		}, func() float64 {
+			return float64(sp.Stats().Entries)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "spool", Name: "bytes",
+			Help: "Size of the spool's segment files on disk.",
+		}, func() float64 {
+			return float64(sp.Stats().Bytes)
+		}),
+	)
+
+	return m
+}
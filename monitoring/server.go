@@ -0,0 +1,70 @@
+package monitoring
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/fsufitch/censys-takehome/config"
+	"github.com/fsufitch/censys-takehome/logging"
+	"github.com/google/wire"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var ErrMonitoring = errors.New("monitoring")
+
+// Server serves the monitoring endpoints over HTTP
+type Server struct {
+	Context   context.Context
+	Config    config.MonitoringConfiguration
+	Log       logging.LogFunc
+	Metrics   *Metrics
+	Readiness ReadinessChecks
+}
+
+func (srv *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(srv.Metrics.Registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/healthz", srv.handleHealthz)
+	mux.HandleFunc("/readyz", srv.handleReadyz)
+	return mux
+}
+
+// Run serves until the context is done; if no address is configured, it does nothing
+func (srv *Server) Run() error {
+	if srv.Config.Address == "" {
+		srv.Log().Info().Msg("monitoring server disabled")
+		return nil
+	}
+
+	httpServer := &http.Server{
+		Addr:        srv.Config.Address,
+		Handler:     srv.Handler(),
+		BaseContext: func(net.Listener) context.Context { return srv.Context },
+	}
+
+	go func() {
+		<-srv.Context.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			srv.Log().Err(err).Msg("error shutting down monitoring server")
+		}
+	}()
+
+	srv.Log().Info().Str("address", srv.Config.Address).Msg("monitoring server starting")
+	if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("%w: %w", ErrMonitoring, err)
+	}
+	srv.Log().Warn().Msg("monitoring server shutting down")
+	return nil
+}
+
+var ProvideMonitoring = wire.NewSet(
+	ProvideMetrics,
+	ProvideReadinessChecks,
+	wire.Struct(new(Server), "*"),
+)
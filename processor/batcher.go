@@ -0,0 +1,206 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/fsufitch/censys-takehome/config"
+	"github.com/fsufitch/censys-takehome/database"
+	"github.com/fsufitch/censys-takehome/logging"
+	"github.com/fsufitch/censys-takehome/monitoring"
+)
+
+var ErrBatcher = errors.New("batcher")
+
+// BatchCallback is called exactly once for every entry added to the batcher, after its batch is written (or fails to be)
+type BatchCallback func(database.UpsertResult, error)
+
+type pendingEntry struct {
+	ctx   context.Context
+	entry database.ScanEntry
+	done  BatchCallback
+}
+
+// Batcher accumulates entries and writes them to the database in a single transaction
+type Batcher struct {
+	Context      context.Context
+	Config       config.BatchConfiguration
+	Log          logging.LogFunc
+	ScanEntryDAO *database.ScanEntryDAO
+	Metrics      *monitoring.Metrics
+	Breaker      *database.CircuitBreaker
+	Flow         *FlowController
+
+	pending chan pendingEntry
+}
+
+func ProvideBatcher(ctx context.Context, conf config.BatchConfiguration, logFunc logging.LogFunc, dao *database.ScanEntryDAO, metrics *monitoring.Metrics, breaker *database.CircuitBreaker, flow *FlowController) *Batcher {
+	if conf.Size < 1 {
+		conf.Size = 1
+	}
+	return &Batcher{
+		Context:      ctx,
+		Config:       conf,
+		Log:          logFunc,
+		ScanEntryDAO: dao,
+		Metrics:      metrics,
+		Breaker:      breaker,
+		Flow:         flow,
+
+		pending: make(chan pendingEntry, conf.Size),
+	}
+}
+
+// Add queues an entry for the next batch; it blocks while the queue is full, which applies backpressure to the caller.
+// The context bounds how long the entry may wait, as well as the write of the batch it ends up in.
+func (b *Batcher) Add(ctx context.Context, entry database.ScanEntry, done BatchCallback) {
+	select {
+	case <-b.Context.Done():
+		done(database.UpsertResult_Undefined, fmt.Errorf("%w: shutting down", ErrBatcher))
+	case <-ctx.Done():
+		done(database.UpsertResult_Undefined, fmt.Errorf("%w: gave up waiting to be batched: %w", ErrBatcher, ctx.Err()))
+	case b.pending <- pendingEntry{ctx: ctx, entry: entry, done: done}:
+	}
+}
+
+// Run is the worker that collects and flushes batches; it returns once the context is done
+func (b *Batcher) Run() {
+	workerLog := b.Log().With().Str("worker", "batcher").Int("size", b.Config.Size).Dur("maxLatency", b.Config.MaxLatency).Logger()
+	workerLog.Debug().Msg("worker starting")
+
+	batch := make([]pendingEntry, 0, b.Config.Size)
+	var deadline <-chan time.Time
+
+worker:
+	for {
+		select {
+		case <-b.Context.Done():
+			break worker
+		case p := <-b.pending:
+			batch = append(batch, p)
+			if len(batch) == 1 {
+				deadline = time.After(b.Config.MaxLatency)
+			}
+			if len(batch) < b.Config.Size {
+				continue
+			}
+		case <-deadline:
+		}
+
+		b.flush(batch)
+		batch = batch[:0]
+		deadline = nil
+	}
+
+	// Anything still around could not be written; let the callers know so the messages are redelivered
+	errQuit := fmt.Errorf("%w: shutting down", ErrBatcher)
+	for _, p := range batch {
+		p.done(database.UpsertResult_Undefined, errQuit)
+	}
+	for {
+		select {
+		case p := <-b.pending:
+			p.done(database.UpsertResult_Undefined, errQuit)
+		default:
+			workerLog.Warn().Msg("worker terminating")
+			return
+		}
+	}
+}
+
+func (b *Batcher) flush(pending []pendingEntry) {
+	// Entries whose context ended while waiting are left out; the rest bound the write by their earliest deadline
+	batch := make([]pendingEntry, 0, len(pending))
+	var deadline time.Time
+	for _, p := range pending {
+		if err := p.ctx.Err(); err != nil {
+			p.done(database.UpsertResult_Undefined, fmt.Errorf("%w: expired before being written: %w", ErrBatcher, err))
+			continue
+		}
+		if d, ok := p.ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+			deadline = d
+		}
+		batch = append(batch, p)
+	}
+	if len(batch) == 0 {
+		return
+	}
+
+	ctx := b.Context
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(b.Context, deadline)
+		defer cancel()
+	}
+
+	entries := make([]database.ScanEntry, len(batch))
+	for i, p := range batch {
+		entries[i] = p.entry
+	}
+
+	results, errs, err := writeOrSplit(ctx, b.Log, entries, b.write)
+	for i, p := range batch {
+		switch {
+		case err != nil:
+			p.done(database.UpsertResult_Undefined, err)
+		case errs[i] != nil:
+			p.done(database.UpsertResult_Undefined, errs[i])
+		default:
+			p.done(results[i], nil)
+		}
+	}
+}
+
+// writeOrSplit writes entries in a single transaction with write. A single bad entry fails the whole transaction, so
+// if it fails permanently, the entries are written one at a time instead, so that only the bad ones fail; errs then
+// holds what failed each of them. Any other failure fails the whole batch, and is returned as err.
+func writeOrSplit(ctx context.Context, logFunc logging.LogFunc, entries []database.ScanEntry, write func(context.Context, []database.ScanEntry) ([]database.UpsertResult, error)) (results []database.UpsertResult, errs []error, err error) {
+	results, err = write(ctx, entries)
+	switch {
+	case err == nil:
+		return results, make([]error, len(entries)), nil
+	case database.ClassifyError(err) != database.ErrorKind_Permanent:
+		return nil, nil, err
+	case len(entries) == 1:
+		return make([]database.UpsertResult, 1), []error{err}, nil
+	}
+
+	logFunc().Warn().Err(err).Int("entries", len(entries)).Msg("batch failed permanently; writing its entries one at a time")
+	results = make([]database.UpsertResult, len(entries))
+	errs = make([]error, len(entries))
+	for i := range entries {
+		single, err := write(ctx, entries[i:i+1])
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		results[i] = single[0]
+	}
+	return results, errs, nil
+}
+
+// write records entries in a single transaction, through the circuit breaker
+func (b *Batcher) write(ctx context.Context, entries []database.ScanEntry) ([]database.UpsertResult, error) {
+	var results []database.UpsertResult
+	start := time.Now()
+	err := b.Breaker.Do(func() (err error) {
+		results, err = b.ScanEntryDAO.AddEntries(ctx, entries)
+		return err
+	})
+	elapsed := time.Since(start)
+	b.Metrics.UpsertDuration.Observe(elapsed.Seconds())
+	b.Metrics.BatchSize.Observe(float64(len(entries)))
+	if !errors.Is(err, database.ErrCircuitOpen) {
+		b.Flow.Observe(elapsed)
+	}
+
+	L := b.Log().With().Int("entries", len(entries)).Dur("elapsed", elapsed).Logger()
+	if err != nil {
+		L.Err(err).Stringer("kind", database.ClassifyError(err)).Msg("batch failed")
+		return nil, err
+	}
+	L.Debug().Msg("batch written")
+	return results, nil
+}
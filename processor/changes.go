@@ -0,0 +1,281 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/fsufitch/censys-takehome/config"
+	"github.com/fsufitch/censys-takehome/database"
+	"github.com/fsufitch/censys-takehome/logging"
+	"github.com/fsufitch/censys-takehome/monitoring"
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+var ErrChangeSink = errors.New("change sink")
+
+// Change sink kinds, as configured
+const (
+	ChangeSink_None     = ""
+	ChangeSink_Postgres = "postgres"
+	ChangeSink_Pubsub   = "pubsub"
+	ChangeSink_File     = "file"
+)
+
+// ChangeEvent is emitted whenever an upsert replaces a service's response with a different one
+type ChangeEvent struct {
+	IP         string    `json:"ip"`
+	Port       uint32    `json:"port"`
+	Service    string    `json:"service"`
+	MessageID  string    `json:"message_id,omitempty"`
+	OldHash    string    `json:"old_hash"` // Hex SHA-256, as in scan_contents
+	NewHash    string    `json:"new_hash"`
+	OldUpdated time.Time `json:"old_updated"`
+	NewUpdated time.Time `json:"new_updated"`
+	Diff       string    `json:"diff,omitempty"` // Unified diff of the responses' text
+}
+
+// NewChangeEvent compares a stored entry with the one replacing it; ok is false if the response did not change
+func NewChangeEvent(old database.ScanEntry, new database.ScanEntry) (event ChangeEvent, ok bool) {
+	if bytes.Equal(old.Content(), new.Content()) {
+		return ChangeEvent{}, false
+	}
+
+	key := new.Key()
+	event = ChangeEvent{
+		IP:         key.IP,
+		Port:       key.Port,
+		Service:    key.Service,
+		MessageID:  new.MessageID,
+		OldHash:    hex.EncodeToString(database.ContentHash(old.Content())),
+		NewHash:    hex.EncodeToString(database.ContentHash(new.Content())),
+		OldUpdated: old.Updated,
+		NewUpdated: new.Updated,
+	}
+
+	name := fmt.Sprintf("%s:%d/%s", key.IP, key.Port, key.Service)
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(old.Data),
+		B:        difflib.SplitLines(new.Data),
+		FromFile: name,
+		FromDate: old.Updated.Format(time.RFC3339),
+		ToFile:   name,
+		ToDate:   new.Updated.Format(time.RFC3339),
+		Context:  3,
+	})
+	if err == nil {
+		event.Diff = diff
+	}
+
+	return event, true
+}
+
+// Relaying works through the outbox in chunks of changeRelayBatch, every changeRelayInterval
+const (
+	changeRelayBatch    = 100
+	changeRelayInterval = time.Second
+)
+
+// ChangeRelay sends the changes waiting in the outbox to the sink as change events, removing them once they are
+// emitted. Changes are recorded in the outbox within the same transaction as the entries which made them, so events
+// are emitted at least once for every write (whatever wrote it), even across crashes and sink failures.
+type ChangeRelay struct {
+	Context       context.Context
+	Log           logging.LogFunc
+	ScanChangeDAO *database.ScanChangeDAO
+	Sink          ChangeSink
+	Metrics       *monitoring.Metrics
+}
+
+// Run relays changes until the context is done
+func (r ChangeRelay) Run() {
+	workerLog := r.Log().With().Str("worker", "changeRelay").Logger()
+	workerLog.Debug().Msg("worker starting")
+
+	ticker := time.NewTicker(changeRelayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context.Done():
+			workerLog.Warn().Msg("worker terminating")
+			return
+		case <-ticker.C:
+		}
+
+		// Keep going while there is a full batch's worth, so a backlog doesn't take an interval per batch
+		for r.Context.Err() == nil {
+			n, err := r.relay()
+			if err != nil {
+				workerLog.Err(err).Msg("failed to relay change events; will try again")
+				break
+			}
+			if n < changeRelayBatch {
+				break
+			}
+		}
+	}
+}
+
+// relay emits a single batch of changes, returning how many there were
+func (r ChangeRelay) relay() (int, error) {
+	return r.ScanChangeDAO.RelayChanges(r.Context, changeRelayBatch, func(changes []database.PendingChange) error {
+		events := make([]ChangeEvent, 0, len(changes))
+		for _, c := range changes {
+			if ev, ok := NewChangeEvent(c.Old, c.New); ok {
+				events = append(events, ev)
+			}
+		}
+		if err := r.Sink.Emit(r.Context, events); err != nil {
+			r.Metrics.ChangeEvents.WithLabelValues("failed").Add(float64(len(events)))
+			return err
+		}
+		r.Metrics.ChangeEvents.WithLabelValues("emitted").Add(float64(len(events)))
+		return nil
+	})
+}
+
+// ChangeSink is somewhere change events are sent to
+type ChangeSink interface {
+	Emit(ctx context.Context, events []ChangeEvent) error
+}
+
+// ProvideChangeSink picks the sink to use according to the configuration
+func ProvideChangeSink(conf config.ChangesConfiguration, logFunc logging.LogFunc, dao *database.ScanChangeDAO, client *pubsub.Client) (ChangeSink, func(), error) {
+	switch conf.Sink {
+	case ChangeSink_None:
+		return discardChangeSink{}, func() {}, nil
+
+	case ChangeSink_Postgres:
+		return &PostgresChangeSink{ScanChangeDAO: dao}, func() {}, nil
+
+	case ChangeSink_Pubsub:
+		if conf.TopicID == "" {
+			return nil, nil, fmt.Errorf("%w: no topic configured", ErrChangeSink)
+		}
+		sink := &PubsubChangeSink{Log: logFunc, topic: client.Topic(conf.TopicID)}
+		cleanup := func() {
+			logFunc().Info().Msg("cleaning up change event publisher")
+			sink.topic.Stop()
+		}
+		return sink, cleanup, nil
+
+	case ChangeSink_File:
+		if conf.Path == "" || conf.Path == "-" {
+			return &FileChangeSink{w: os.Stdout}, func() {}, nil
+		}
+		f, err := os.OpenFile(conf.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %w", ErrChangeSink, err)
+		}
+		cleanup := func() {
+			logFunc().Info().Str("path", conf.Path).Msg("closing change event file")
+			f.Close()
+		}
+		return &FileChangeSink{w: f}, cleanup, nil
+
+	default:
+		return nil, nil, fmt.Errorf("%w: unknown sink %q", ErrChangeSink, conf.Sink)
+	}
+}
+
+type discardChangeSink struct{}
+
+func (discardChangeSink) Emit(context.Context, []ChangeEvent) error { return nil }
+
+// PostgresChangeSink records change events in the scan_changes table
+type PostgresChangeSink struct {
+	ScanChangeDAO *database.ScanChangeDAO
+}
+
+func (sink *PostgresChangeSink) Emit(ctx context.Context, events []ChangeEvent) error {
+	changes := make([]database.ScanChange, 0, len(events))
+	for _, ev := range events {
+		oldHash, err := hex.DecodeString(ev.OldHash)
+		if err != nil {
+			return fmt.Errorf("%w: bad old hash: %w", ErrChangeSink, err)
+		}
+		newHash, err := hex.DecodeString(ev.NewHash)
+		if err != nil {
+			return fmt.Errorf("%w: bad new hash: %w", ErrChangeSink, err)
+		}
+		changes = append(changes, database.ScanChange{
+			Key:        database.ScanEntryKey{IP: ev.IP, Port: ev.Port, Service: ev.Service},
+			MessageID:  ev.MessageID,
+			OldHash:    oldHash,
+			NewHash:    newHash,
+			OldUpdated: ev.OldUpdated,
+			NewUpdated: ev.NewUpdated,
+			Diff:       ev.Diff,
+		})
+	}
+
+	if err := sink.ScanChangeDAO.AddChanges(ctx, changes); err != nil {
+		return fmt.Errorf("%w: %w", ErrChangeSink, err)
+	}
+	return nil
+}
+
+// PubsubChangeSink publishes change events as JSON messages, with the key in the attributes for filtering
+type PubsubChangeSink struct {
+	Log logging.LogFunc
+
+	topic *pubsub.Topic
+}
+
+func (sink *PubsubChangeSink) Emit(ctx context.Context, events []ChangeEvent) error {
+	results := make([]*pubsub.PublishResult, 0, len(events))
+	for _, ev := range events {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrChangeSink, err)
+		}
+		results = append(results, sink.topic.Publish(ctx, &pubsub.Message{
+			Data: data,
+			Attributes: map[string]string{
+				"ip":      ev.IP,
+				"port":    strconv.Itoa(int(ev.Port)),
+				"service": ev.Service,
+			},
+		}))
+	}
+
+	errs := []error{}
+	for _, result := range results {
+		if _, err := result.Get(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("%w: publish failed: %w", ErrChangeSink, err)
+	}
+	sink.Log().Debug().Int("events", len(events)).Msg("published change events")
+	return nil
+}
+
+// FileChangeSink appends change events to a file, one JSON object per line
+type FileChangeSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (sink *FileChangeSink) Emit(ctx context.Context, events []ChangeEvent) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+
+	enc := json.NewEncoder(sink.w)
+	for _, ev := range events {
+		if err := enc.Encode(ev); err != nil {
+			return fmt.Errorf("%w: %w", ErrChangeSink, err)
+		}
+	}
+	return nil
+}
@@ -1,12 +1,18 @@
 package processor
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
-	"unicode/utf8"
+
+	"github.com/fsufitch/censys-takehome/database"
+	"github.com/fsufitch/censys-takehome/validation"
+	"github.com/google/wire"
 )
 
 var ErrData = errors.New("data error")
+var ErrUnmarshal = errors.New("unmarshal error")
+var ErrUnknownDataVersion = fmt.Errorf("%w: unknown data version", ErrData)
 
 type DataVersion int
 
@@ -14,38 +20,119 @@ const (
 	DataVersion_Undefined = iota
 	DataVersion_1
 	DataVersion_2
+	DataVersion_3
 )
 
 type Scan struct {
-	IP          string      `json:"ip"`
-	Port        uint32      `json:"port"`
-	Service     string      `json:"service"`
-	Timestamp   int64       `json:"timestamp"`
-	DataVersion DataVersion `json:"data_version"`
-	Data        struct {
-		V1Data
-		V2Data
-	} `json:"data"`
-}
-
-type V1Data struct {
-	ResponseBytesUtf8 []byte `json:"response_bytes_utf8"`
-}
-
-type V2Data struct {
-	ResponseStr string `json:"response_str"`
-}
-
-func (sc Scan) DataString() (string, error) {
-	switch sc.DataVersion {
-	case DataVersion_1:
-		if !utf8.Valid(sc.Data.ResponseBytesUtf8) {
-			return "", fmt.Errorf("%w: received invalid UTF-8 data", ErrData)
-		}
-		return string(sc.Data.ResponseBytesUtf8), nil
-	case DataVersion_2:
-		return sc.Data.V2Data.ResponseStr, nil
-	default:
-		return "", fmt.Errorf("%w: unknown data version number (%d)", ErrData, sc.DataVersion)
+	IP          string          `json:"ip"`
+	Port        uint32          `json:"port"`
+	Service     string          `json:"service"`
+	Timestamp   int64           `json:"timestamp"`
+	DataVersion DataVersion     `json:"data_version"`
+	Data        json.RawMessage `json:"data"` // Shape depends on DataVersion; see DataDecoderRegistry
+}
+
+// ScanContent is the normalized content of a scan's data, whichever version it came in
+type ScanContent struct {
+	Text     string            // The service response, as text
+	Raw      []byte            // The service response bytes, if the data version carries them
+	Encoding string            // How Text was rendered from Raw; see RenderText
+	Metadata map[string]string // Extra version-specific information, if any
+}
+
+// DataDecoder decodes the "data" of a single data version
+type DataDecoder interface {
+	DecodeData(json.RawMessage) (ScanContent, error)
+}
+
+// DataDecoderFunc adapts a plain function into a DataDecoder
+type DataDecoderFunc func(json.RawMessage) (ScanContent, error)
+
+func (f DataDecoderFunc) DecodeData(raw json.RawMessage) (ScanContent, error) {
+	return f(raw)
+}
+
+// DataDecoderRegistry keeps track of which decoder handles which data version
+type DataDecoderRegistry struct {
+	decoders map[DataVersion]DataDecoder
+}
+
+func NewDataDecoderRegistry() *DataDecoderRegistry {
+	return &DataDecoderRegistry{decoders: map[DataVersion]DataDecoder{}}
+}
+
+// ProvideDataDecoderRegistry provides a registry with all the data versions this processor knows about
+func ProvideDataDecoderRegistry() *DataDecoderRegistry {
+	registry := NewDataDecoderRegistry()
+	registry.Register(DataVersion_1, DataDecoderFunc(decodeV1Data))
+	registry.Register(DataVersion_2, DataDecoderFunc(decodeV2Data))
+	registry.Register(DataVersion_3, DataDecoderFunc(decodeV3Data))
+	return registry
+}
+
+// Register adds (or replaces) the decoder for a data version
+func (r *DataDecoderRegistry) Register(version DataVersion, decoder DataDecoder) {
+	r.decoders[version] = decoder
+}
+
+func (r *DataDecoderRegistry) Decode(version DataVersion, raw json.RawMessage) (ScanContent, error) {
+	decoder, ok := r.decoders[version]
+	if !ok {
+		return ScanContent{}, fmt.Errorf("%w (%d)", ErrUnknownDataVersion, version)
 	}
+	return decoder.DecodeData(raw)
+}
+
+// Decoder turns the raw payloads of messages into entries ready for the database
+type Decoder struct {
+	Validator    *validation.Validator
+	DataDecoders *DataDecoderRegistry
+}
+
+// DecodedScan is the result of decoding a message; DataVersion is filled in even if decoding fails later on
+type DecodedScan struct {
+	Entry       database.ScanEntry
+	DataVersion DataVersion
 }
+
+func (d *Decoder) Decode(data []byte) (DecodedScan, error) {
+	scan := Scan{}
+	if err := json.Unmarshal(data, &scan); err != nil {
+		return DecodedScan{}, fmt.Errorf("%w: %w", ErrUnmarshal, err)
+	}
+	decoded := DecodedScan{DataVersion: scan.DataVersion}
+
+	ip, ipErr := d.Validator.IP(scan.IP)
+	portErr := d.Validator.Port(scan.Port)
+	serviceErr := d.Validator.Service(scan.Service)
+	updated, timestampErr := d.Validator.Timestamp(scan.Timestamp)
+	if err := errors.Join(ipErr, portErr, serviceErr, timestampErr); err != nil {
+		return decoded, err
+	}
+
+	content, err := d.DataDecoders.Decode(scan.DataVersion, scan.Data)
+	if err != nil {
+		return decoded, err
+	}
+
+	decoded.Entry = database.ScanEntry{
+		IP:       ip,
+		Port:     scan.Port,
+		Service:  scan.Service,
+		Updated:  updated,
+		Data:     content.Text,
+		Encoding: Encoding_UTF8,
+		Metadata: content.Metadata,
+	}
+	if content.Encoding != "" && content.Encoding != Encoding_UTF8 {
+		// The text is only an approximation, so keep the exact bytes too
+		decoded.Entry.Raw = content.Raw
+		decoded.Entry.Encoding = content.Encoding
+	}
+	return decoded, nil
+}
+
+var ProvideDecoder = wire.NewSet(
+	wire.Struct(new(Decoder), "*"),
+	ProvideDataDecoderRegistry,
+)
@@ -0,0 +1,20 @@
+package processor
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type V1Data struct {
+	ResponseBytesUtf8 []byte `json:"response_bytes_utf8"`
+}
+
+func decodeV1Data(raw json.RawMessage) (ScanContent, error) {
+	data := V1Data{}
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return ScanContent{}, fmt.Errorf("%w: bad v1 data: %w", ErrData, err)
+	}
+	// Despite the name, binary responses (TLS handshakes and the like) come through here too
+	text, encoding := RenderText(data.ResponseBytesUtf8)
+	return ScanContent{Text: text, Raw: data.ResponseBytesUtf8, Encoding: encoding}, nil
+}
@@ -0,0 +1,21 @@
+package processor
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type V2Data struct {
+	ResponseStr string `json:"response_str"`
+}
+
+func decodeV2Data(raw json.RawMessage) (ScanContent, error) {
+	data := V2Data{}
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return ScanContent{}, fmt.Errorf("%w: bad v2 data: %w", ErrData, err)
+	}
+	// JSON strings may still carry NULs (as \u0000), which Postgres text can't store, so they are rendered like bytes
+	response := []byte(data.ResponseStr)
+	text, encoding := RenderText(response)
+	return ScanContent{Text: text, Raw: response, Encoding: encoding}, nil
+}
@@ -0,0 +1,27 @@
+package processor
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// V3Data carries the raw response as base64, along with free-form metadata about how it was obtained
+type V3Data struct {
+	ResponseBase64 string            `json:"response_base64"`
+	Metadata       map[string]string `json:"metadata"`
+}
+
+func decodeV3Data(raw json.RawMessage) (ScanContent, error) {
+	data := V3Data{}
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return ScanContent{}, fmt.Errorf("%w: bad v3 data: %w", ErrData, err)
+	}
+
+	response, err := base64.StdEncoding.DecodeString(data.ResponseBase64)
+	if err != nil {
+		return ScanContent{}, fmt.Errorf("%w: bad v3 base64 response: %w", ErrData, err)
+	}
+	text, encoding := RenderText(response)
+	return ScanContent{Text: text, Raw: response, Encoding: encoding, Metadata: data.Metadata}, nil
+}
@@ -0,0 +1,110 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/fsufitch/censys-takehome/config"
+	"github.com/fsufitch/censys-takehome/database"
+	"github.com/fsufitch/censys-takehome/logging"
+	"github.com/fsufitch/censys-takehome/validation"
+)
+
+var ErrDeadLetterSink = errors.New("dead letter sink")
+
+// Error classes for dead letters, so they can be listed and replayed selectively
+const (
+	ErrorClass_Exhausted      = "retries_exhausted" // Kept failing with errors which are normally retried
+	ErrorClass_Database       = "database"          // Postgres refused to record the entry
+	ErrorClass_Unmarshal      = "unmarshal"
+	ErrorClass_UnknownVersion = "unknown_version" // Parked until a decoder for the version ships
+	ErrorClass_Data           = "data"
+	ErrorClass_Invalid        = "invalid"
+	ErrorClass_Unknown        = "unknown"
+)
+
+func ErrorClass(err error) string {
+	switch {
+	case errors.Is(err, ErrRetriesExhausted):
+		return ErrorClass_Exhausted
+	case database.ClassifyError(err) == database.ErrorKind_Permanent:
+		return ErrorClass_Database
+	case errors.Is(err, ErrUnmarshal):
+		return ErrorClass_Unmarshal
+	case errors.Is(err, ErrUnknownDataVersion):
+		return ErrorClass_UnknownVersion
+	case errors.Is(err, ErrData):
+		return ErrorClass_Data
+	case errors.Is(err, validation.ErrValidation):
+		return ErrorClass_Invalid
+	default:
+		return ErrorClass_Unknown
+	}
+}
+
+// DeadLetterSender keeps messages which could not be processed, so they can be acked
+type DeadLetterSender interface {
+	Send(ctx context.Context, msgID string, data []byte, attributes map[string]string, cause error) error
+}
+
+// DeadLetterSink keeps messages which could not be processed, in the database and optionally on a Pubsub topic
+type DeadLetterSink struct {
+	Log           logging.LogFunc
+	DeadLetterDAO *database.DeadLetterDAO
+
+	topic *pubsub.Topic // nil if no dead letter topic is configured
+}
+
+func ProvideDeadLetterSink(conf config.PubsubConfiguration, logFunc logging.LogFunc, dao *database.DeadLetterDAO, client *pubsub.Client) (*DeadLetterSink, func()) {
+	sink := &DeadLetterSink{
+		Log:           logFunc,
+		DeadLetterDAO: dao,
+	}
+	if conf.DeadLetterTopicID == "" {
+		return sink, func() {}
+	}
+
+	sink.topic = client.Topic(conf.DeadLetterTopicID)
+	cleanup := func() {
+		logFunc().Info().Msg("cleaning up dead letter publisher")
+		sink.topic.Stop()
+	}
+	return sink, cleanup
+}
+
+// Send records a message that failed with the given error. Only once it returns nil is it safe to ack the message.
+func (sink *DeadLetterSink) Send(ctx context.Context, msgID string, data []byte, attributes map[string]string, cause error) error {
+	dl := database.DeadLetter{
+		MessageID:  msgID,
+		Data:       data,
+		Attributes: attributes,
+		ErrorClass: ErrorClass(cause),
+		Error:      cause.Error(),
+	}
+
+	if err := sink.DeadLetterDAO.AddDeadLetter(ctx, dl); err != nil {
+		return fmt.Errorf("%w: %w", ErrDeadLetterSink, err)
+	}
+
+	if sink.topic == nil {
+		return nil
+	}
+
+	publishAttributes := map[string]string{}
+	for k, v := range attributes {
+		publishAttributes[k] = v
+	}
+	publishAttributes["original_message_id"] = msgID
+	publishAttributes["error_class"] = dl.ErrorClass
+	publishAttributes["error"] = dl.Error
+
+	serverID, err := sink.topic.Publish(ctx, &pubsub.Message{Data: data, Attributes: publishAttributes}).Get(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: publish failed: %w", ErrDeadLetterSink, err)
+	}
+	sink.Log().Debug().Str("msgID", msgID).Str("deadLetterMsgID", serverID).Msg("published dead letter")
+
+	return nil
+}
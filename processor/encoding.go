@@ -0,0 +1,116 @@
+package processor
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Encodings a response's text may have been rendered from
+const (
+	Encoding_UTF8    = "utf-8"
+	Encoding_UTF16LE = "utf-16le"
+	Encoding_UTF16BE = "utf-16be"
+	Encoding_Latin1  = "latin-1"
+	Encoding_Escaped = "escaped" // Binary data; printable ASCII is kept, everything else is written as \xNN
+)
+
+// latin1Threshold is the share of bytes which must look like Latin-1 text for a response to be read as Latin-1
+const latin1Threshold = 0.9
+
+// RenderText makes a best-effort text rendering of a response, and says which encoding it applied. Only UTF-8 renders
+// the exact bytes; for everything else, the raw bytes need to be kept alongside to be lossless. The rendering never
+// contains NUL characters, which Postgres text can't store.
+func RenderText(raw []byte) (text string, encoding string) {
+	if utf8.Valid(raw) && bytes.IndexByte(raw, 0) < 0 {
+		return string(raw), Encoding_UTF8
+	}
+	if text, encoding, ok := decodeUTF16(raw); ok {
+		return text, encoding
+	}
+	if bytes.IndexByte(raw, 0) < 0 && looksLatin1(raw) {
+		runes := make([]rune, len(raw))
+		for i, b := range raw {
+			runes[i] = rune(b) // Latin-1 maps bytes to the first 256 code points
+		}
+		return string(runes), Encoding_Latin1
+	}
+	return escapeBinary(raw), Encoding_Escaped
+}
+
+// decodeUTF16 reads UTF-16 with a byte order mark, or without one if every other byte is mostly zero (as with
+// mostly-ASCII text)
+func decodeUTF16(raw []byte) (string, string, bool) {
+	if len(raw) < 2 || len(raw)%2 != 0 {
+		return "", "", false
+	}
+
+	encoding := ""
+	switch {
+	case raw[0] == 0xFF && raw[1] == 0xFE:
+		encoding, raw = Encoding_UTF16LE, raw[2:]
+	case raw[0] == 0xFE && raw[1] == 0xFF:
+		encoding, raw = Encoding_UTF16BE, raw[2:]
+	default:
+		evenZeros, oddZeros := 0, 0
+		for i := 0; i < len(raw); i += 2 {
+			if raw[i] == 0 {
+				evenZeros++
+			}
+			if raw[i+1] == 0 {
+				oddZeros++
+			}
+		}
+		pairs := len(raw) / 2
+		switch {
+		case oddZeros*4 >= pairs*3 && evenZeros*4 < pairs:
+			encoding = Encoding_UTF16LE
+		case evenZeros*4 >= pairs*3 && oddZeros*4 < pairs:
+			encoding = Encoding_UTF16BE
+		default:
+			return "", "", false
+		}
+	}
+
+	units := make([]uint16, len(raw)/2)
+	for i := range units {
+		if encoding == Encoding_UTF16LE {
+			units[i] = uint16(raw[2*i]) | uint16(raw[2*i+1])<<8
+		} else {
+			units[i] = uint16(raw[2*i])<<8 | uint16(raw[2*i+1])
+		}
+	}
+	text := string(utf16.Decode(units))
+	if strings.ContainsRune(text, utf8.RuneError) || strings.ContainsRune(text, 0) {
+		return "", "", false
+	}
+	return text, encoding, true
+}
+
+// looksLatin1 says whether nearly all bytes are printable in Latin-1, i.e. there are hardly any control characters
+func looksLatin1(raw []byte) bool {
+	printable := 0
+	for _, b := range raw {
+		if (b >= 0x20 && b < 0x7F) || b >= 0xA0 || b == '\t' || b == '\n' || b == '\r' {
+			printable++
+		}
+	}
+	return float64(printable) >= latin1Threshold*float64(len(raw))
+}
+
+func escapeBinary(raw []byte) string {
+	var sb strings.Builder
+	for _, b := range raw {
+		switch {
+		case b == '\\':
+			sb.WriteString(`\\`)
+		case (b >= 0x20 && b < 0x7F) || b == '\n':
+			sb.WriteByte(b)
+		default:
+			fmt.Fprintf(&sb, `\x%02x`, b)
+		}
+	}
+	return sb.String()
+}
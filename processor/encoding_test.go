@@ -0,0 +1,38 @@
+package processor
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderText(t *testing.T) {
+	tests := []struct {
+		name         string
+		raw          []byte
+		wantText     string
+		wantEncoding string
+	}{
+		{"empty", []byte{}, "", Encoding_UTF8},
+		{"ascii", []byte("HTTP/1.1 200 OK\r\n"), "HTTP/1.1 200 OK\r\n", Encoding_UTF8},
+		{"utf-8", []byte("héllo wörld"), "héllo wörld", Encoding_UTF8},
+		{"utf-16le with bom", []byte{0xFF, 0xFE, 'h', 0, 'i', 0}, "hi", Encoding_UTF16LE},
+		{"utf-16be with bom", []byte{0xFE, 0xFF, 0, 'h', 0, 'i'}, "hi", Encoding_UTF16BE},
+		{"utf-16le without bom", []byte{'h', 0, 'e', 0, 'l', 0, 'l', 0, 'o', 0}, "hello", Encoding_UTF16LE},
+		{"utf-16be without bom", []byte{0, 'h', 0, 'e', 0, 'l', 0, 'l', 0, 'o'}, "hello", Encoding_UTF16BE},
+		{"latin-1", []byte("caf\xe9 cr\xe8me br\xfbl\xe9e"), "café crème brûlée", Encoding_Latin1},
+		{"nul in otherwise utf-8", []byte("ab\x00c"), `ab\x00c`, Encoding_Escaped},
+		{"binary", []byte{0x01, 0x02, 0xFF, '\\', 'A', '\n'}, "\\x01\\x02\\xff\\\\A\n", Encoding_Escaped},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, encoding := RenderText(tt.raw)
+			if text != tt.wantText || encoding != tt.wantEncoding {
+				t.Errorf("RenderText(%q) = %q, %q; want %q, %q", tt.raw, text, encoding, tt.wantText, tt.wantEncoding)
+			}
+			if strings.ContainsRune(text, 0) {
+				t.Errorf("RenderText(%q) contains NUL", tt.raw)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package processor
+
+import (
+	"errors"
+
+	"github.com/fsufitch/censys-takehome/database"
+	"github.com/fsufitch/censys-takehome/validation"
+)
+
+// ErrRetriesExhausted wraps an error which would have been retried, if the message had not been delivered too often
+var ErrRetriesExhausted = errors.New("retries exhausted")
+
+// Disposition is what to do with a message which could not be recorded
+type Disposition int
+
+const (
+	Disposition_Retry  Disposition = iota // Nack it so it is redelivered; whatever went wrong may well go away
+	Disposition_Reject                    // Keep it as a dead letter and ack it; it would fail the same way every time
+	Disposition_Drop                      // Ack it without keeping it; it is not wanted
+)
+
+func (d Disposition) String() string {
+	switch d {
+	case Disposition_Retry:
+		return "retry"
+	case Disposition_Reject:
+		return "reject"
+	case Disposition_Drop:
+		return "drop"
+	default:
+		return "undefined"
+	}
+}
+
+// Classify decides what to do with a message which failed with the given error:
+//   - Scans older than the configured maximum age are dropped; they would only get older.
+//   - Anything else which can't be decoded or fails validation is rejected, and so are entries Postgres refuses
+//     (data exceptions, constraint violations, and the like) and messages whose retries are exhausted.
+//   - Everything else (connection trouble, timeouts, shutting down, transient Postgres errors, and whatever is not
+//     known to be permanent) is retried.
+func Classify(err error) Disposition {
+	fieldErr := validation.FieldError{}
+	switch {
+	case errors.As(err, &fieldErr) && fieldErr.Reason == validation.Reason_TooOld:
+		return Disposition_Drop
+	case errors.Is(err, ErrRetriesExhausted):
+		return Disposition_Reject
+	case errors.Is(err, ErrUnmarshal), errors.Is(err, ErrData), errors.Is(err, validation.ErrValidation):
+		return Disposition_Reject
+	case database.ClassifyError(err) == database.ErrorKind_Permanent:
+		return Disposition_Reject
+	default:
+		return Disposition_Retry
+	}
+}
@@ -0,0 +1,159 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/fsufitch/censys-takehome/config"
+	"github.com/fsufitch/censys-takehome/logging"
+	"github.com/fsufitch/censys-takehome/messaging"
+	"github.com/fsufitch/censys-takehome/monitoring"
+)
+
+// flowAdjustInterval is how often the adaptive flow control reconsiders its limit
+const flowAdjustInterval = time.Second
+
+// FlowController limits how many messages are processed at once. Messages waiting for it are still outstanding as
+// far as Pubsub is concerned, so a lower limit also slows down how fast messages are pulled.
+//
+// In adaptive mode, the limit follows the database: it is cut by a quarter whenever batches take longer than the
+// target latency to write, and grows by a tenth while they are faster and the limit is what holds messages back.
+// Otherwise, it lets every message through.
+type FlowController struct {
+	Config  config.PubsubConfiguration
+	Log     logging.LogFunc
+	Metrics *monitoring.Metrics
+
+	mu         sync.Mutex
+	min, max   int
+	limit      int
+	inFlight   int
+	waiting    int
+	released   chan struct{} // Closed (and replaced) whenever a slot frees up or the limit grows
+	latencySum time.Duration
+	latencyN   int
+	lastAdjust time.Time
+}
+
+// ProvideFlowController sets up flow control within the maximum number of outstanding messages (Pubsub's default if
+// it is 0). Adaptive flow control needs that maximum as its ceiling, so it can't be combined with no limit at all.
+func ProvideFlowController(conf config.PubsubConfiguration, logFunc logging.LogFunc, metrics *monitoring.Metrics) (*FlowController, error) {
+	upper := conf.MaxOutstandingMessages
+	if upper < 0 && conf.AdaptiveFlow {
+		return nil, fmt.Errorf("%w: adaptive flow control needs a limit on outstanding messages", ErrProcessor)
+	}
+	if upper <= 0 {
+		upper = pubsub.DefaultReceiveSettings.MaxOutstandingMessages
+	}
+	lower := min(max(conf.MinOutstandingMessages, 1), upper)
+
+	fc := &FlowController{
+		Config:     conf,
+		Log:        logFunc,
+		Metrics:    metrics,
+		min:        lower,
+		max:        upper,
+		limit:      upper,
+		released:   make(chan struct{}),
+		lastAdjust: time.Now(),
+	}
+	metrics.FlowLimit.Set(float64(fc.limit))
+	return fc, nil
+}
+
+// Acquire waits for a slot to process a message in, until the context is done; the returned function frees it
+func (fc *FlowController) Acquire(ctx context.Context) (release func(), err error) {
+	if !fc.Config.AdaptiveFlow {
+		return func() {}, nil
+	}
+
+	fc.mu.Lock()
+	fc.waiting++
+	for fc.inFlight >= fc.limit {
+		released := fc.released
+		fc.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			fc.mu.Lock()
+			fc.waiting--
+			fc.mu.Unlock()
+			return nil, fmt.Errorf("%w: gave up waiting for flow control: %w", ErrProcessor, ctx.Err())
+		case <-released:
+		}
+		fc.mu.Lock()
+	}
+	fc.waiting--
+	fc.inFlight++
+	fc.Metrics.MessagesInFlight.Set(float64(fc.inFlight))
+	fc.mu.Unlock()
+
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			fc.mu.Lock()
+			defer fc.mu.Unlock()
+			fc.inFlight--
+			fc.Metrics.MessagesInFlight.Set(float64(fc.inFlight))
+			fc.notify()
+		})
+	}, nil
+}
+
+// Observe takes note of how long a batch took to write, adjusting the limit every flowAdjustInterval
+func (fc *FlowController) Observe(latency time.Duration) {
+	if !fc.Config.AdaptiveFlow {
+		return
+	}
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	fc.latencySum += latency
+	fc.latencyN++
+	if time.Since(fc.lastAdjust) < flowAdjustInterval {
+		return
+	}
+	average := fc.latencySum / time.Duration(fc.latencyN)
+	fc.latencySum, fc.latencyN, fc.lastAdjust = 0, 0, time.Now()
+
+	limit := fc.limit
+	switch {
+	case average > fc.Config.TargetLatency:
+		limit = limit * 3 / 4
+	case fc.waiting > 0:
+		limit += (limit + 9) / 10
+	}
+	limit = min(max(limit, fc.min), fc.max)
+	if limit == fc.limit {
+		return
+	}
+
+	fc.Log().Debug().Int("from", fc.limit).Int("to", limit).Dur("latency", average).Msg("adjusted flow control limit")
+	fc.limit = limit
+	fc.Metrics.FlowLimit.Set(float64(limit))
+	fc.notify()
+}
+
+func (fc *FlowController) notify() {
+	close(fc.released)
+	fc.released = make(chan struct{})
+}
+
+// releasingMessage frees its flow control slot once it is acked or nacked
+type releasingMessage struct {
+	messaging.Message
+	release func()
+}
+
+func (m releasingMessage) Ack() {
+	m.Message.Ack()
+	m.release()
+}
+
+func (m releasingMessage) Nack() {
+	m.Message.Nack()
+	m.release()
+}
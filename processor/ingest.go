@@ -0,0 +1,278 @@
+package processor
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsufitch/censys-takehome/config"
+	"github.com/fsufitch/censys-takehome/database"
+	"github.com/fsufitch/censys-takehome/logging"
+	"github.com/google/wire"
+)
+
+var ErrIngest = errors.New("ingest")
+
+// StdinName is the input name which stands for standard input
+const StdinName = "-"
+
+// Ingester reads newline-delimited JSON scans from files and records them the same way the processor does
+type Ingester struct {
+	Context       context.Context
+	Config        config.BatchConfiguration
+	Log           logging.LogFunc
+	Decoder       *Decoder
+	ScanEntryDAO  *database.ScanEntryDAO
+	DeadLetterDAO *database.DeadLetterDAO
+}
+
+type IngestSummary struct {
+	Files    int
+	Records  int
+	Accepted int // Inserted or updated
+	Stale    int // Decoded fine, but a newer entry was already recorded
+	Rejected int // Could not be decoded, or refused by Postgres; kept as dead letters
+	Dropped  int // Not wanted (see Classify); not kept at all
+	Bytes    int64
+}
+
+// IngestCheckpoint keeps the offset (in decompressed bytes) up to which each input was fully recorded
+type IngestCheckpoint struct {
+	Path    string           `json:"-"`
+	Offsets map[string]int64 `json:"offsets"`
+}
+
+// LoadIngestCheckpoint reads a checkpoint file; if the path is empty or the file does not exist yet, the checkpoint starts out empty
+func LoadIngestCheckpoint(path string) (*IngestCheckpoint, error) {
+	cp := &IngestCheckpoint{Path: path, Offsets: map[string]int64{}}
+	if path == "" {
+		return cp, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cp, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: failed reading checkpoint: %w", ErrIngest, err)
+	}
+
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, fmt.Errorf("%w: failed decoding checkpoint (%s): %w", ErrIngest, path, err)
+	}
+	if cp.Offsets == nil {
+		cp.Offsets = map[string]int64{}
+	}
+	return cp, nil
+}
+
+// Save writes the checkpoint to disk atomically, so a crash never leaves a half-written file behind
+func (cp *IngestCheckpoint) Save() error {
+	if cp.Path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return fmt.Errorf("%w: failed encoding checkpoint: %w", ErrIngest, err)
+	}
+
+	tmpPath := cp.Path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return fmt.Errorf("%w: failed writing checkpoint: %w", ErrIngest, err)
+	}
+	if err := os.Rename(tmpPath, cp.Path); err != nil {
+		return fmt.Errorf("%w: failed writing checkpoint: %w", ErrIngest, err)
+	}
+	return nil
+}
+
+// ExpandInputs resolves globs into file names; no patterns at all means standard input
+func ExpandInputs(patterns []string) ([]string, error) {
+	if len(patterns) == 0 {
+		return []string{StdinName}, nil
+	}
+
+	names := []string{}
+	for _, pattern := range patterns {
+		if pattern == StdinName {
+			names = append(names, StdinName)
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad pattern (%s): %w", ErrIngest, pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("%w: no files match %s", ErrIngest, pattern)
+		}
+		names = append(names, matches...)
+	}
+	return names, nil
+}
+
+// Ingest records every input in order, reporting progress to the log every progressInterval
+func (ing Ingester) Ingest(names []string, cp *IngestCheckpoint, progressInterval time.Duration) (IngestSummary, error) {
+	summary := IngestSummary{}
+	lastProgress := time.Now()
+	progress := func() {
+		if progressInterval <= 0 || time.Since(lastProgress) < progressInterval {
+			return
+		}
+		lastProgress = time.Now()
+		ing.Log().Info().Int("records", summary.Records).Int("accepted", summary.Accepted).Int("stale", summary.Stale).
+			Int("rejected", summary.Rejected).Int64("bytes", summary.Bytes).Msg("ingest progress")
+	}
+
+	for _, name := range names {
+		if err := ing.ingestInput(name, cp, &summary, progress); err != nil {
+			return summary, err
+		}
+		summary.Files++
+	}
+	return summary, nil
+}
+
+func (ing Ingester) ingestInput(name string, cp *IngestCheckpoint, summary *IngestSummary, progress func()) error {
+	L := ing.Log().With().Str("input", name).Logger()
+
+	var input io.Reader = os.Stdin
+	if name != StdinName {
+		f, err := os.Open(name)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrIngest, err)
+		}
+		defer f.Close()
+		input = f
+	}
+
+	reader := bufio.NewReader(input)
+	if magic, _ := reader.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		L.Debug().Msg("input is gzipped")
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return fmt.Errorf("%w: bad gzip input (%s): %w", ErrIngest, name, err)
+		}
+		defer gz.Close()
+		reader = bufio.NewReader(gz)
+	}
+
+	offset := cp.Offsets[name]
+	if offset > 0 {
+		L.Info().Int64("offset", offset).Msg("resuming from checkpoint")
+		if _, err := io.CopyN(io.Discard, reader, offset); err != nil {
+			return fmt.Errorf("%w: could not skip to checkpoint offset %d (%s): %w", ErrIngest, offset, name, err)
+		}
+	}
+
+	batchSize := ing.Config.Size
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	batch := make([]database.ScanEntry, 0, batchSize)
+	lines := make([][]byte, 0, batchSize) // The record each entry of the batch came from, to dead-letter it if need be
+
+	flush := func() error {
+		if len(batch) > 0 {
+			// Entries Postgres refuses are kept as dead letters like undecodable records; anything else stops the
+			// ingest, to be resumed from the last checkpoint
+			results, errs, err := writeOrSplit(ing.Context, ing.Log, batch, ing.ScanEntryDAO.AddEntries)
+			if err != nil {
+				return err
+			}
+			for i, result := range results {
+				switch {
+				case errs[i] != nil && Classify(errs[i]) != Disposition_Reject:
+					return errs[i]
+				case errs[i] != nil:
+					summary.Rejected++
+					L.Err(errs[i]).Str("msgID", batch[i].MessageID).Msg("rejected record")
+					if err := ing.deadLetter(name, batch[i].MessageID, lines[i], errs[i]); err != nil {
+						return err
+					}
+				case result == database.UpsertResult_Stale:
+					summary.Stale++
+				default:
+					summary.Accepted++
+				}
+			}
+			batch = batch[:0]
+			lines = lines[:0]
+		}
+
+		// Everything up to here is recorded, so a restart can pick up from this offset
+		cp.Offsets[name] = offset
+		return cp.Save()
+	}
+
+	for {
+		select {
+		case <-ing.Context.Done():
+			return fmt.Errorf("%w: interrupted: %w", ErrIngest, ing.Context.Err())
+		default:
+		}
+
+		line, readErr := reader.ReadBytes('\n')
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			return fmt.Errorf("%w: read failed (%s): %w", ErrIngest, name, readErr)
+		}
+		lineOffset := offset
+		offset += int64(len(line))
+		summary.Bytes += int64(len(line))
+
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			summary.Records++
+			msgID := fmt.Sprintf("ingest:%s:%d", name, lineOffset)
+			decoded, err := ing.Decoder.Decode(line)
+			if err != nil && Classify(err) == Disposition_Drop {
+				summary.Dropped++
+				L.Warn().Err(err).Int64("offset", lineOffset).Msg("dropped record")
+			} else if err != nil {
+				summary.Rejected++
+				L.Err(err).Int64("offset", lineOffset).Msg("rejected record")
+				if err := ing.deadLetter(name, msgID, line, err); err != nil {
+					return err
+				}
+			} else {
+				decoded.Entry.MessageID = msgID
+				batch = append(batch, decoded.Entry)
+				lines = append(lines, line)
+			}
+		}
+
+		if len(batch) >= batchSize || errors.Is(readErr, io.EOF) {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		progress()
+
+		if errors.Is(readErr, io.EOF) {
+			L.Info().Int64("offset", offset).Msg("input done")
+			return nil
+		}
+	}
+}
+
+// deadLetter keeps a rejected record of the named input
+func (ing Ingester) deadLetter(name string, msgID string, line []byte, err error) error {
+	return ing.DeadLetterDAO.AddDeadLetter(ing.Context, database.DeadLetter{
+		MessageID:  msgID,
+		Data:       line,
+		Attributes: map[string]string{"input": name},
+		ErrorClass: ErrorClass(err),
+		Error:      err.Error(),
+	})
+}
+
+var ProvideIngester = wire.NewSet(
+	wire.Struct(new(Ingester), "*"),
+	ProvideDecoder,
+)
@@ -2,88 +2,229 @@ package processor
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"net"
+	"strconv"
 	"time"
 
-	"cloud.google.com/go/pubsub"
 	"github.com/fsufitch/censys-takehome/config"
 	"github.com/fsufitch/censys-takehome/database"
 	"github.com/fsufitch/censys-takehome/logging"
+	"github.com/fsufitch/censys-takehome/messaging"
+	"github.com/fsufitch/censys-takehome/monitoring"
+	"github.com/fsufitch/censys-takehome/spool"
+	"github.com/fsufitch/censys-takehome/validation"
 	"github.com/google/wire"
+	"github.com/rs/zerolog"
 )
 
 var ErrProcessor = errors.New("processor")
 
 type Processor struct {
-	Context      context.Context
-	Config       config.PubsubConfiguration
-	Log          logging.LogFunc
-	ScanEntryDAO *database.ScanEntryDAO
+	Context     context.Context
+	Config      config.ProcessorConfiguration
+	Log         logging.LogFunc
+	Source      messaging.MessageSource
+	Decoder     *Decoder
+	Batcher     *Batcher
+	DeadLetters DeadLetterSender
+	Metrics     *monitoring.Metrics
+	Database    *database.DatabaseConnector
+	Spool       *spool.Spool // nil if spooling is disabled
+	Drainer     SpoolDrainer
+	Breaker     *database.CircuitBreaker
+	Flow        *FlowController
+	Changes     ChangeRelay
 }
 
 func (proc *Processor) Run() error {
 	proc.Log().Info().Msg("processor starting")
 
-	proc.Log().Debug().Str("project", proc.Config.ProjectID).Msg("connecting to pubsub")
-	client, err := pubsub.NewClient(proc.Context, proc.Config.ProjectID)
-	if err != nil {
-		return fmt.Errorf("%w: failed connecting to pubsub (%s): %w", ErrProcessor, proc.Config.ProjectID, err)
-	}
+	go proc.Batcher.Run()
+	go proc.Drainer.Run()
+	go proc.Changes.Run()
 
-	proc.Log().Debug().Msg("getting subscription")
-	subscription := client.Subscription(proc.Config.SubscriptionID)
-	if exists, err := subscription.Exists(proc.Context); !exists || err != nil {
-		return fmt.Errorf("%w: subscription does not exist (%s): %w", ErrProcessor, proc.Config.SubscriptionID, err)
+	if err := proc.Source.Receive(proc.Context, proc.receive); err != nil {
+		return fmt.Errorf("%w: %w", ErrProcessor, err)
 	}
 
-	subscription.Receive(proc.Context, proc.receive)
-
 	proc.Log().Warn().Msg("processor shutting down")
 
 	return nil
 }
 
-func (proc *Processor) receive(msgContext context.Context, msg *pubsub.Message) {
-	L := proc.Log().With().Str("msgID", msg.ID).Logger()
+func (proc *Processor) receive(msgContext context.Context, msg messaging.Message) {
+	L := proc.Log().With().Str("msgID", msg.ID()).Logger()
 	L.Info().Msg("received message")
 
-	scan := Scan{}
-	err := json.Unmarshal(msg.Data, &scan)
+	release, err := proc.Flow.Acquire(msgContext)
 	if err != nil {
-		L.Err(err).Bytes("data", msg.Data).Msg("failed to unmarshal message data")
-		msg.Ack() // Ack so it doesn't get delivered again
+		L.Err(err).Msg("gave up waiting for flow control")
+		proc.Metrics.MessagesNacked.WithLabelValues("flow_control").Inc()
+		msg.Nack()
 		return
 	}
+	msg = releasingMessage{Message: msg, release: release}
+
+	// Without a spool to fall back on, hold on to messages while the breaker is open rather than fail them all; this
+	// also stops Pubsub from delivering more once the maximum number of outstanding messages is reached
+	if proc.Spool == nil && proc.Breaker.State() == database.BreakerState_Open {
+		L.Debug().Msg("waiting for circuit breaker")
+		if err := proc.Breaker.Wait(msgContext); err != nil {
+			L.Err(err).Msg("gave up waiting for circuit breaker")
+			proc.Metrics.MessagesNacked.WithLabelValues("circuit_open").Inc()
+			msg.Nack()
+			return
+		}
+	}
+
+	ctx, cancel := proc.messageContext(msgContext)
+
+	decodeStart := time.Now()
+	decoded, err := proc.Decoder.Decode(msg.Data())
+	proc.Metrics.DecodeDuration.Observe(time.Since(decodeStart).Seconds())
+
+	dataVersion := strconv.Itoa(int(decoded.DataVersion))
+	proc.Metrics.MessagesReceived.WithLabelValues(dataVersion).Inc()
 
-	scanData, err := scan.DataString()
 	if err != nil {
-		L.Err(err).Bytes("data", msg.Data).Msg("failed to extract entry data")
-		msg.Ack() // Ack so it doesn't get delivered again
+		defer cancel()
+		fieldErr := validation.FieldError{}
+		if errors.As(err, &fieldErr) {
+			L = L.With().Str("field", fieldErr.Field).Str("reason", fieldErr.Reason).Logger()
+		}
+		L.Err(err).Bytes("data", msg.Data()).Msg("could not decode message")
+		proc.Metrics.MessagesRejected.WithLabelValues(ErrorClass(err), dataVersion).Inc()
+		proc.fail(ctx, L, msg, err, "decode_error")
 		return
 	}
 
-	entry := database.ScanEntry{
-		IP:      net.ParseIP(scan.IP),
-		Port:    scan.Port,
-		Service: scan.Service,
-		Updated: time.Unix(scan.Timestamp, 0),
-		Data:    scanData,
+	entry := decoded.Entry
+	entry.MessageID = msg.ID()
+	L.Info().Any("entry", entry).Msg("extracted entry from message")
+
+	if proc.Spool != nil && proc.Database.Reconnecting() {
+		defer cancel()
+		proc.spoolEntry(L, msg, entry, "database reconnecting")
+		return
+	}
+	if proc.Spool != nil && proc.Breaker.State() == database.BreakerState_Open {
+		defer cancel()
+		proc.spoolEntry(L, msg, entry, "circuit breaker open")
+		return
 	}
 
-	L.Info().Any("entry", entry).Msg("extracted entry from message")
+	// The message is acked or nacked once its batch is written, which may be after this callback returns
+	proc.Batcher.Add(ctx, entry, func(result database.UpsertResult, err error) {
+		if err != nil {
+			// This runs on the batcher's worker; spooling and dead-lettering may take a while, and must not hold up
+			// the next batch
+			go func() {
+				defer cancel()
+				proc.writeFailed(ctx, msgContext, L, msg, entry, err)
+			}()
+			return
+		}
+		defer cancel()
+
+		L := L.With().Stringer("result", result).Logger()
+		if result == database.UpsertResult_Stale {
+			L.Info().Msg("skipped stale entry; a newer one is already recorded")
+		} else {
+			L.Info().Msg("successfully recorded entry")
+			proc.Metrics.ScanLag.Observe(time.Since(entry.Updated).Seconds())
+		}
+		proc.Metrics.MessagesAcked.WithLabelValues(result.String()).Inc()
+		msg.Ack() // Stale entries are acked too; redelivering them would never change the outcome
+	})
+}
 
-	err = proc.ScanEntryDAO.AddEntry(entry)
-	if err != nil {
+// writeFailed handles an entry whose batch could not be written, spooling it if the database looks unavailable
+func (proc *Processor) writeFailed(ctx context.Context, msgContext context.Context, L zerolog.Logger, msg messaging.Message, entry database.ScanEntry, err error) {
+	switch {
+	case proc.Spool != nil && shouldSpool(err):
+		proc.spoolEntry(L, msg, entry, err.Error())
+	case ctx.Err() != nil:
+		L.Err(err).Dur("timeout", proc.Config.MessageTimeout).Msg("timed out upserting entry")
+		proc.fail(msgContext, L, msg, err, "timeout") // Not ctx; it is over, but dead-lettering still needs time
+	default:
 		L.Err(err).Msg("error upserting entry")
-		msg.Nack() // Do *not* acknowledge it; it is a valid entry and should be retried
-		return
+		proc.fail(msgContext, L, msg, err, "upsert_error")
+	}
+}
+
+// fail acks or nacks a message which could not be recorded, according to how its error is classified. Messages
+// which would be retried are rejected instead once they were delivered MaxDeliveryAttempts times.
+func (proc *Processor) fail(ctx context.Context, L zerolog.Logger, msg messaging.Message, err error, reason string) {
+	disposition := Classify(err)
+	attempt := msg.DeliveryAttempt()
+	if disposition == Disposition_Retry && proc.Config.MaxDeliveryAttempts > 0 && attempt >= proc.Config.MaxDeliveryAttempts {
+		err = fmt.Errorf("%w after %d delivery attempts: %w", ErrRetriesExhausted, attempt, err)
+		disposition = Disposition_Reject
 	}
+	L = L.With().Stringer("disposition", disposition).Int("deliveryAttempt", attempt).Logger()
+
+	switch disposition {
+	case Disposition_Drop:
+		L.Warn().Err(err).Msg("dropped message")
+		proc.Metrics.MessagesAcked.WithLabelValues("dropped").Inc()
+		msg.Ack()
+
+	case Disposition_Reject:
+		if err := proc.DeadLetters.Send(ctx, msg.ID(), msg.Data(), msg.Attributes(), err); err != nil {
+			L.Err(err).Msg("failed to dead-letter message")
+			proc.Metrics.MessagesNacked.WithLabelValues("dead_letter_error").Inc()
+			msg.Nack() // Retry, rather than lose it
+			return
+		}
+		L.Warn().Err(err).Msg("rejected message; kept as a dead letter")
+		proc.Metrics.MessagesAcked.WithLabelValues("dead_lettered").Inc()
+		msg.Ack() // Ack so it doesn't get delivered again; it is kept as a dead letter
+
+	default:
+		proc.Metrics.MessagesNacked.WithLabelValues(reason).Inc()
+		msg.Nack() // It may well succeed next time
+	}
+}
+
+// shouldSpool tells whether an entry which failed to be written should be spooled: whenever the database looks
+// unavailable, whether the breaker says so or the error itself does (connection errors, shutdowns, and the like)
+func shouldSpool(err error) bool {
+	return errors.Is(err, database.ErrCircuitOpen) || database.ClassifyError(err) == database.ErrorKind_Transient
+}
 
-	L.Info().Msg("successfully recorded entry")
+// spoolEntry keeps the entry on disk until the database is available again, acking the message once that is durable
+func (proc *Processor) spoolEntry(L zerolog.Logger, msg messaging.Message, entry database.ScanEntry, reason string) {
+	if err := proc.Spool.Append(entry); err != nil {
+		L.Err(err).Msg("failed to spool entry")
+		proc.Metrics.MessagesNacked.WithLabelValues("spool_error").Inc()
+		msg.Nack() // Nothing else to keep it in; it has to be redelivered
+		return
+	}
+	L.Info().Str("reason", reason).Msg("spooled entry until the database is available")
+	proc.Metrics.MessagesAcked.WithLabelValues("spooled").Inc()
 	msg.Ack()
 }
 
-var ProvideProcessor = wire.Struct(new(Processor), "Context", "Config", "Log", "ScanEntryDAO")
+// messageContext bounds the processing of a single message by the configured timeout, if any
+func (proc *Processor) messageContext(msgContext context.Context) (context.Context, context.CancelFunc) {
+	if proc.Config.MessageTimeout <= 0 {
+		return context.WithCancel(msgContext)
+	}
+	return context.WithTimeout(msgContext, proc.Config.MessageTimeout)
+}
+
+var ProvideProcessor = wire.NewSet(
+	wire.Struct(new(Processor), "Context", "Config", "Log", "Source", "Decoder", "Batcher", "DeadLetters", "Metrics", "Database", "Spool", "Drainer", "Breaker", "Flow", "Changes"),
+	wire.Struct(new(ChangeRelay), "*"),
+	wire.Bind(new(DeadLetterSender), new(*DeadLetterSink)),
+	ProvideFlowController,
+	database.ProvideCircuitBreaker,
+	wire.Struct(new(SpoolDrainer), "*"),
+	wire.Bind(new(EntryWriter), new(*Batcher)),
+	spool.ProvideSpool,
+	ProvideDecoder,
+	ProvideBatcher,
+	ProvideDeadLetterSink,
+	ProvideChangeSink,
+)
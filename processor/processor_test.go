@@ -0,0 +1,223 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fsufitch/censys-takehome/config"
+	"github.com/fsufitch/censys-takehome/database"
+	"github.com/fsufitch/censys-takehome/logging"
+	"github.com/fsufitch/censys-takehome/messaging"
+	"github.com/fsufitch/censys-takehome/monitoring"
+	"github.com/fsufitch/censys-takehome/spool"
+	"github.com/fsufitch/censys-takehome/validation"
+	"github.com/rs/zerolog"
+)
+
+// testDeadLetters records what is sent to it, or fails if told to
+type testDeadLetters struct {
+	mu      sync.Mutex
+	classes []string
+	data    [][]byte
+	fail    bool
+}
+
+func (d *testDeadLetters) Send(_ context.Context, _ string, data []byte, _ map[string]string, cause error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.fail {
+		return fmt.Errorf("%w: unavailable", ErrDeadLetterSink)
+	}
+	d.classes = append(d.classes, ErrorClass(cause))
+	d.data = append(d.data, data)
+	return nil
+}
+
+type receiveSetup struct {
+	spool           bool
+	breakerOpen     bool
+	failDeadLetters bool
+	maxAttempts     int
+}
+
+// newTestProcessor builds a processor whose database is always unavailable, as if Postgres went away after startup
+func newTestProcessor(t *testing.T, setup receiveSetup) (*Processor, *testDeadLetters) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	nop := zerolog.Nop()
+	logFunc := logging.LogFunc(func() *zerolog.Logger { return &nop })
+
+	downCtx, down := context.WithCancel(context.Background())
+	down()
+	dbc := &database.DatabaseConnector{Context: downCtx, Log: logFunc}
+
+	breakerConf := config.BreakerConfiguration{OpenDuration: time.Hour}
+	if setup.breakerOpen {
+		breakerConf.FailureThreshold = 1
+	}
+	breaker := database.ProvideCircuitBreaker(breakerConf, logFunc)
+	if setup.breakerOpen {
+		breaker.Do(func() error { return database.ErrConnection })
+	}
+
+	var sp *spool.Spool
+	if setup.spool {
+		var err error
+		if sp, err = spool.Open(config.SpoolConfiguration{Dir: t.TempDir()}, logFunc); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { sp.Close() })
+	}
+
+	metrics := monitoring.ProvideMetrics(dbc, sp, breaker)
+	flow, err := ProvideFlowController(config.PubsubConfiguration{}, logFunc, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batcher := ProvideBatcher(ctx, config.BatchConfiguration{Size: 1, MaxLatency: time.Millisecond}, logFunc,
+		&database.ScanEntryDAO{DatabaseConnector: dbc}, metrics, breaker, flow)
+	go batcher.Run()
+
+	deadLetters := &testDeadLetters{fail: setup.failDeadLetters}
+	return &Processor{
+		Context: ctx,
+		Config:  config.ProcessorConfiguration{MaxDeliveryAttempts: setup.maxAttempts},
+		Log:     logFunc,
+		Decoder: &Decoder{
+			Validator:    validation.ProvideValidator(config.ValidationConfiguration{MaxClockSkew: time.Minute, MaxAge: 24 * time.Hour}),
+			DataDecoders: ProvideDataDecoderRegistry(),
+		},
+		Batcher:     batcher,
+		DeadLetters: deadLetters,
+		Metrics:     metrics,
+		Database:    dbc,
+		Spool:       sp,
+		Breaker:     breaker,
+		Flow:        flow,
+	}, deadLetters
+}
+
+func scanMessage(timestamp int64, port int) string {
+	return fmt.Sprintf(`{"ip":"1.2.3.4","port":%d,"service":"HTTP","timestamp":%d,"data_version":2,"data":{"response_str":"hello"}}`,
+		port, timestamp)
+}
+
+func TestProcessorReceive(t *testing.T) {
+	now := time.Now().Unix()
+
+	tests := []struct {
+		name        string
+		setup       receiveSetup
+		data        string
+		attempt     int
+		wantAck     bool
+		wantClasses []string
+		wantSpooled int
+	}{
+		{
+			name:        "undecodable messages are rejected",
+			data:        "not json",
+			wantAck:     true,
+			wantClasses: []string{ErrorClass_Unmarshal},
+		},
+		{
+			name:        "invalid messages are rejected",
+			data:        scanMessage(now, 0),
+			wantAck:     true,
+			wantClasses: []string{ErrorClass_Invalid},
+		},
+		{
+			name:        "unknown data versions are rejected",
+			data:        fmt.Sprintf(`{"ip":"1.2.3.4","port":80,"service":"HTTP","timestamp":%d,"data_version":99,"data":{}}`, now),
+			wantAck:     true,
+			wantClasses: []string{ErrorClass_UnknownVersion},
+		},
+		{
+			name:    "rejected messages are retried if they can't be dead-lettered",
+			setup:   receiveSetup{failDeadLetters: true},
+			data:    "not json",
+			wantAck: false,
+		},
+		{
+			name:    "scans too old are dropped",
+			data:    scanMessage(now-48*3600, 80),
+			wantAck: true,
+		},
+		{
+			name:    "entries are retried while the database is down",
+			data:    scanMessage(now, 80),
+			wantAck: false,
+		},
+		{
+			name:        "entries are spooled while the database is down",
+			setup:       receiveSetup{spool: true},
+			data:        scanMessage(now, 80),
+			wantAck:     true,
+			wantSpooled: 1,
+		},
+		{
+			name:        "entries are spooled while the breaker is open",
+			setup:       receiveSetup{spool: true, breakerOpen: true},
+			data:        scanMessage(now, 80),
+			wantAck:     true,
+			wantSpooled: 1,
+		},
+		{
+			name:        "entries are rejected once their retries are exhausted",
+			setup:       receiveSetup{maxAttempts: 3},
+			data:        scanMessage(now, 80),
+			attempt:     3,
+			wantAck:     true,
+			wantClasses: []string{ErrorClass_Exhausted},
+		},
+		{
+			name:    "entries are retried before their retries are exhausted",
+			setup:   receiveSetup{maxAttempts: 3},
+			data:    scanMessage(now, 80),
+			attempt: 2,
+			wantAck: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proc, deadLetters := newTestProcessor(t, tt.setup)
+
+			acked := make(chan bool, 2)
+			msg := &messaging.MemoryMessage{
+				MessageID: "msg",
+				Payload:   []byte(tt.data),
+				Attempt:   tt.attempt,
+				OnAck:     func() { acked <- true },
+				OnNack:    func() { acked <- false },
+			}
+			proc.receive(proc.Context, msg)
+
+			select {
+			case ack := <-acked:
+				if ack != tt.wantAck {
+					t.Errorf("acked = %v, want %v", ack, tt.wantAck)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("message was neither acked nor nacked")
+			}
+			select {
+			case <-acked:
+				t.Error("message was acked or nacked more than once")
+			case <-time.After(10 * time.Millisecond):
+			}
+
+			if fmt.Sprint(deadLetters.classes) != fmt.Sprint(tt.wantClasses) {
+				t.Errorf("dead letter classes = %v, want %v", deadLetters.classes, tt.wantClasses)
+			}
+			if spooled := proc.Spool.Stats().Entries; spooled != tt.wantSpooled {
+				t.Errorf("spooled %d entries, want %d", spooled, tt.wantSpooled)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package processor
+
+import (
+	"context"
+
+	"github.com/fsufitch/censys-takehome/config"
+	"github.com/fsufitch/censys-takehome/database"
+	"github.com/fsufitch/censys-takehome/logging"
+	"github.com/google/wire"
+)
+
+// Replayer pushes dead letters through decoding again, e.g. once a fix for their failure ships
+type Replayer struct {
+	Context       context.Context
+	Config        config.BatchConfiguration
+	Log           logging.LogFunc
+	Decoder       *Decoder
+	DeadLetterDAO *database.DeadLetterDAO
+	ScanEntryDAO  *database.ScanEntryDAO
+}
+
+type ReplaySummary struct {
+	Recorded int // Written to the database and removed from the dead letters
+	Stale    int // Decoded fine, but a newer entry was already recorded; removed from the dead letters
+	Dropped  int // Not wanted anymore (see Classify); removed from the dead letters
+	Failed   int // Still could not be decoded or written; kept as dead letters
+}
+
+// Replay writes the dead letters matching the filter (up to its limit, if any) in batches, each in a single
+// transaction along with removing its dead letters. Dead letters are loaded a batch at a time, in order of their IDs.
+// Batches which fail permanently are split up, so only the bad dead letters are kept.
+func (r Replayer) Replay(filter database.DeadLetterFilter) (ReplaySummary, error) {
+	summary := ReplaySummary{}
+	batchSize := max(r.Config.Size, 1)
+	remaining := filter.Limit
+
+	page := filter
+	for {
+		page.Limit = batchSize
+		if filter.Limit > 0 {
+			page.Limit = min(batchSize, remaining)
+		}
+		deadLetters, err := r.DeadLetterDAO.ListDeadLetters(r.Context, page)
+		if err != nil {
+			return summary, err
+		}
+		if len(deadLetters) == 0 {
+			return summary, nil
+		}
+		r.Log().Debug().Int("count", len(deadLetters)).Int64("afterID", page.AfterID).Msg("replaying dead letters")
+
+		if err := r.replayBatch(deadLetters, &summary); err != nil {
+			return summary, err
+		}
+
+		page.AfterID = deadLetters[len(deadLetters)-1].ID
+		remaining -= len(deadLetters)
+		if len(deadLetters) < page.Limit || (filter.Limit > 0 && remaining <= 0) {
+			return summary, nil
+		}
+	}
+}
+
+// replayBatch decodes dead letters, and writes the resulting entries in a single transaction along with removing
+// their dead letters
+func (r Replayer) replayBatch(deadLetters []database.DeadLetter, summary *ReplaySummary) error {
+	batch := make([]database.ScanEntry, 0, len(deadLetters))
+	byMessageID := map[string]database.DeadLetter{}
+	dropped := []int64{}
+
+	for _, dl := range deadLetters {
+		L := r.Log().With().Int64("deadLetter", dl.ID).Str("msgID", dl.MessageID).Logger()
+
+		decoded, err := r.Decoder.Decode(dl.Data)
+		switch {
+		case err != nil && Classify(err) == Disposition_Drop:
+			L.Warn().Err(err).Msg("dropping dead letter")
+			summary.Dropped++
+			dropped = append(dropped, dl.ID)
+		case err != nil:
+			if err := r.keep(dl, err, summary); err != nil {
+				return err
+			}
+		default:
+			decoded.Entry.MessageID = dl.MessageID
+			batch = append(batch, decoded.Entry)
+			byMessageID[dl.MessageID] = dl
+		}
+	}
+
+	if len(dropped) > 0 {
+		if _, err := r.DeadLetterDAO.PurgeDeadLetters(r.Context, database.DeadLetterFilter{IDs: dropped}); err != nil {
+			return err
+		}
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+
+	// write records entries along with removing their dead letters; message IDs of dead letters are unique
+	write := func(ctx context.Context, entries []database.ScanEntry) ([]database.UpsertResult, error) {
+		ids := make([]int64, len(entries))
+		for i, e := range entries {
+			ids[i] = byMessageID[e.MessageID].ID
+		}
+		return r.ScanEntryDAO.AddReplayedEntries(ctx, entries, ids)
+	}
+
+	results, errs, err := writeOrSplit(r.Context, r.Log, batch, write)
+	if err != nil {
+		return err
+	}
+	for i, result := range results {
+		switch {
+		case errs[i] != nil && Classify(errs[i]) != Disposition_Reject:
+			return errs[i]
+		case errs[i] != nil:
+			if err := r.keep(byMessageID[batch[i].MessageID], errs[i], summary); err != nil {
+				return err
+			}
+		case result == database.UpsertResult_Stale:
+			summary.Stale++
+		default:
+			summary.Recorded++
+		}
+	}
+	return nil
+}
+
+// keep updates a dead letter which still fails, with its new error
+func (r Replayer) keep(dl database.DeadLetter, err error, summary *ReplaySummary) error {
+	r.Log().Err(err).Int64("deadLetter", dl.ID).Str("msgID", dl.MessageID).Msg("dead letter still fails")
+	summary.Failed++
+	dl.ErrorClass = ErrorClass(err)
+	dl.Error = err.Error()
+	return r.DeadLetterDAO.AddDeadLetter(r.Context, dl)
+}
+
+var ProvideReplayer = wire.NewSet(
+	wire.Struct(new(Replayer), "*"),
+	ProvideDecoder,
+)
@@ -0,0 +1,192 @@
+package processor
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/fsufitch/censys-takehome/config"
+	"github.com/fsufitch/censys-takehome/database"
+	"github.com/fsufitch/censys-takehome/logging"
+	"github.com/fsufitch/censys-takehome/spool"
+	"github.com/google/wire"
+)
+
+// drainWriteTimeout bounds writing a single chunk of spooled entries, so a database going away mid-drain doesn't
+// hold up the batcher for good
+const drainWriteTimeout = time.Minute
+
+// EntryWriter records entries, reporting what happened to each of them: errs holds what failed single entries (the
+// others may be written regardless), while err fails all of them
+type EntryWriter interface {
+	WriteEntries(ctx context.Context, entries []database.ScanEntry) (results []database.UpsertResult, errs []error, err error)
+}
+
+// DAOEntryWriter writes entries straight to the database, in a single transaction unless some of them fail for good
+type DAOEntryWriter struct {
+	Log          logging.LogFunc
+	ScanEntryDAO *database.ScanEntryDAO
+}
+
+func (w DAOEntryWriter) WriteEntries(ctx context.Context, entries []database.ScanEntry) ([]database.UpsertResult, []error, error) {
+	return writeOrSplit(ctx, w.Log, entries, w.ScanEntryDAO.AddEntries)
+}
+
+// WriteEntries adds the entries to batches like any others (so they get metrics), and waits until all of them are
+// written or failed
+func (b *Batcher) WriteEntries(ctx context.Context, entries []database.ScanEntry) ([]database.UpsertResult, []error, error) {
+	results := make([]database.UpsertResult, len(entries))
+	errs := make([]error, len(entries))
+
+	wg := sync.WaitGroup{}
+	wg.Add(len(entries))
+	for i, entry := range entries {
+		b.Add(ctx, entry, func(result database.UpsertResult, err error) {
+			results[i], errs[i] = result, err
+			wg.Done()
+		})
+	}
+	wg.Wait()
+	return results, errs, nil
+}
+
+type DrainSummary struct {
+	Entries      int
+	Accepted     int // Inserted or updated
+	Stale        int // A newer entry was already recorded
+	DeadLettered int // Refused by the database for good
+}
+
+// SpoolDrainer writes the entries spooled while the database was unavailable, oldest first
+type SpoolDrainer struct {
+	Context     context.Context
+	Config      config.SpoolConfiguration
+	Batch       config.BatchConfiguration
+	Log         logging.LogFunc
+	Spool       *spool.Spool // nil if spooling is disabled
+	Database    *database.DatabaseConnector
+	Writer      EntryWriter
+	DeadLetters DeadLetterSender
+	Breaker     *database.CircuitBreaker // Only used by Run
+}
+
+// Drain writes everything spooled so far. Entries the database refuses for good are dead-lettered, so they don't
+// hold up the rest of the spool; any other failure stops the drain, leaving the failed chunk spooled.
+func (d SpoolDrainer) Drain() (DrainSummary, error) {
+	summary := DrainSummary{}
+	n, err := d.Spool.Drain(d.Context, d.Batch.Size, func(ctx context.Context, entries []database.ScanEntry) error {
+		ctx, cancel := context.WithTimeout(ctx, drainWriteTimeout)
+		defer cancel()
+
+		results, errs, err := d.Writer.WriteEntries(ctx, entries)
+		if err != nil {
+			return err
+		}
+		for _, err := range errs {
+			if err != nil && Classify(err) != Disposition_Reject {
+				return err
+			}
+		}
+
+		chunk := DrainSummary{}
+		for i, entry := range entries {
+			switch {
+			case errs[i] != nil:
+				if err := d.deadLetter(ctx, entry, errs[i]); err != nil {
+					return err
+				}
+				chunk.DeadLettered++
+			case results[i] == database.UpsertResult_Stale:
+				chunk.Stale++
+			default:
+				chunk.Accepted++
+			}
+		}
+		summary.Accepted += chunk.Accepted
+		summary.Stale += chunk.Stale
+		summary.DeadLettered += chunk.DeadLettered
+		return nil
+	})
+	summary.Entries = n
+	return summary, err
+}
+
+// deadLetter keeps a spooled entry which the database refused. The message it came from is gone, so it is kept as
+// an equivalent v3 message, which can be replayed like any other dead letter.
+func (d SpoolDrainer) deadLetter(ctx context.Context, entry database.ScanEntry, cause error) error {
+	response := entry.Raw
+	if response == nil {
+		response = []byte(entry.Data)
+	}
+	v3, err := json.Marshal(V3Data{ResponseBase64: base64.StdEncoding.EncodeToString(response), Metadata: entry.Metadata})
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(Scan{
+		IP:          entry.IP.String(),
+		Port:        entry.Port,
+		Service:     entry.Service,
+		Timestamp:   entry.Updated.Unix(),
+		DataVersion: DataVersion_3,
+		Data:        v3,
+	})
+	if err != nil {
+		return err
+	}
+
+	d.Log().Warn().Err(cause).Str("msgID", entry.MessageID).Msg("dead-lettering spooled entry refused by the database")
+	return d.DeadLetters.Send(ctx, entry.MessageID, data, map[string]string{"source": "spool"}, cause)
+}
+
+// Run drains the spool whenever it has entries and the database looks available (it is not reconnecting, and the
+// circuit breaker is not open), until the context is done
+func (d SpoolDrainer) Run() {
+	if d.Spool == nil {
+		return
+	}
+
+	workerLog := d.Log().With().Str("worker", "spoolDrainer").Dur("interval", d.Config.DrainInterval).Logger()
+	workerLog.Debug().Msg("worker starting")
+
+	ticker := time.NewTicker(d.Config.DrainInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.Context.Done():
+			workerLog.Warn().Msg("worker terminating")
+			return
+		case <-ticker.C:
+		}
+
+		stats := d.Spool.Stats()
+		if stats.Entries == 0 || d.Database.Reconnecting() {
+			continue
+		}
+		if err := d.Breaker.Check(d.Context); err != nil {
+			workerLog.Debug().Err(err).Int("entries", stats.Entries).Msg("not draining spool while the circuit breaker is open")
+			continue
+		}
+
+		workerLog.Info().Int("entries", stats.Entries).Msg("draining spool")
+		summary, err := d.Drain()
+		L := workerLog.With().Int("drained", summary.Entries).Int("accepted", summary.Accepted).Int("stale", summary.Stale).Int("deadLettered", summary.DeadLettered).Logger()
+		if err != nil {
+			L.Err(err).Msg("failed to drain spool; will try again")
+			continue
+		}
+		L.Info().Msg("drained spool")
+	}
+}
+
+// ProvideSpoolDrainer provides a drainer which writes straight to the database, for draining outside the server;
+// dead letters are only kept in the database
+var ProvideSpoolDrainer = wire.NewSet(
+	wire.Struct(new(SpoolDrainer), "Context", "Config", "Batch", "Log", "Spool", "Database", "Writer", "DeadLetters"),
+	wire.Struct(new(DAOEntryWriter), "*"),
+	wire.Bind(new(EntryWriter), new(DAOEntryWriter)),
+	wire.Struct(new(DeadLetterSink), "Log", "DeadLetterDAO"),
+	wire.Bind(new(DeadLetterSender), new(*DeadLetterSink)),
+	spool.ProvideSpool,
+)
@@ -0,0 +1,152 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fsufitch/censys-takehome/config"
+	"github.com/fsufitch/censys-takehome/database"
+	"github.com/fsufitch/censys-takehome/logging"
+	"github.com/fsufitch/censys-takehome/spool"
+	"github.com/fsufitch/censys-takehome/validation"
+	"github.com/lib/pq"
+	"github.com/rs/zerolog"
+)
+
+// testEntryWriter fails the entries whose port has an error set, or the whole chunk if err is set
+type testEntryWriter struct {
+	portErrs map[uint32]error
+	err      error
+}
+
+func (w testEntryWriter) WriteEntries(_ context.Context, entries []database.ScanEntry) ([]database.UpsertResult, []error, error) {
+	if w.err != nil {
+		return nil, nil, w.err
+	}
+	results := make([]database.UpsertResult, len(entries))
+	errs := make([]error, len(entries))
+	for i, entry := range entries {
+		results[i], errs[i] = database.UpsertResult_Inserted, w.portErrs[entry.Port]
+	}
+	return results, errs, nil
+}
+
+func TestSpoolDrainerDrain(t *testing.T) {
+	refused := &pq.Error{Code: "22021", Message: "invalid byte sequence"}
+	down := fmt.Errorf("%w: connection refused", database.ErrConnection)
+
+	tests := []struct {
+		name        string
+		writer      testEntryWriter
+		wantSummary DrainSummary
+		wantErr     error
+		wantLeft    int
+	}{
+		{
+			name:        "everything is written",
+			wantSummary: DrainSummary{Entries: 4, Accepted: 4},
+		},
+		{
+			name:        "refused entries are dead-lettered",
+			writer:      testEntryWriter{portErrs: map[uint32]error{2: refused, 3: refused}},
+			wantSummary: DrainSummary{Entries: 4, Accepted: 2, DeadLettered: 2},
+		},
+		{
+			name:     "transient entry failures stop the drain",
+			writer:   testEntryWriter{portErrs: map[uint32]error{3: down}},
+			wantErr:  database.ErrConnection,
+			wantLeft: 2,
+			// The first chunk of two is done; the second, with the failure, stays spooled
+			wantSummary: DrainSummary{Entries: 2, Accepted: 2},
+		},
+		{
+			name:     "chunk failures stop the drain",
+			writer:   testEntryWriter{err: down},
+			wantErr:  database.ErrConnection,
+			wantLeft: 4,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nop := zerolog.Nop()
+			logFunc := logging.LogFunc(func() *zerolog.Logger { return &nop })
+			sp, err := spool.Open(config.SpoolConfiguration{Dir: t.TempDir()}, logFunc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sp.Close()
+			for port := uint32(1); port <= 4; port++ {
+				entry := database.ScanEntry{
+					IP: net.ParseIP("1.2.3.4"), Port: port, Service: "HTTP", Updated: time.Unix(1700000000, 0),
+					Data: "hello", Metadata: map[string]string{"tls": "1.3"}, MessageID: fmt.Sprint("msg-", port),
+				}
+				if err := sp.Append(entry); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			deadLetters := &testDeadLetters{}
+			drainer := SpoolDrainer{
+				Context:     context.Background(),
+				Batch:       config.BatchConfiguration{Size: 2},
+				Log:         logFunc,
+				Spool:       sp,
+				Writer:      tt.writer,
+				DeadLetters: deadLetters,
+			}
+			summary, err := drainer.Drain()
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+			if summary != tt.wantSummary {
+				t.Errorf("summary = %+v, want %+v", summary, tt.wantSummary)
+			}
+			if left := sp.Stats().Entries; left != tt.wantLeft {
+				t.Errorf("%d entries left spooled, want %d", left, tt.wantLeft)
+			}
+			if len(deadLetters.classes) != tt.wantSummary.DeadLettered {
+				t.Errorf("dead letters = %v, want %d", deadLetters.classes, tt.wantSummary.DeadLettered)
+			}
+		})
+	}
+}
+
+func TestSpoolDrainerDeadLetterReplays(t *testing.T) {
+	nop := zerolog.Nop()
+	deadLetters := &testDeadLetters{}
+	drainer := SpoolDrainer{Log: func() *zerolog.Logger { return &nop }, DeadLetters: deadLetters}
+
+	entry := database.ScanEntry{
+		IP: net.ParseIP("1.2.3.4"), Port: 443, Service: "HTTPS", Updated: time.Now().Truncate(time.Second),
+		Data: `\x01\xff\x00`, Raw: []byte{0x01, 0xFF, 0x00}, Encoding: Encoding_Escaped,
+		Metadata: map[string]string{"tls": "1.3"}, MessageID: "msg",
+	}
+	if err := drainer.deadLetter(context.Background(), entry, &pq.Error{Code: "22021"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(deadLetters.data) != 1 || deadLetters.classes[0] != ErrorClass_Database {
+		t.Fatalf("dead letters = %v, want one of class %s", deadLetters.classes, ErrorClass_Database)
+	}
+
+	// Replaying the dead letter decodes it back into the same entry
+	decoder := Decoder{
+		Validator:    validation.ProvideValidator(config.ValidationConfiguration{MaxClockSkew: time.Minute}),
+		DataDecoders: ProvideDataDecoderRegistry(),
+	}
+	decoded, err := decoder.Decode(deadLetters.data[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded.Entry.MessageID = entry.MessageID
+	got, _ := json.Marshal(decoded.Entry)
+	want, _ := json.Marshal(entry)
+	if string(got) != string(want) {
+		t.Errorf("replayed entry = %s, want %s", got, want)
+	}
+}
@@ -4,6 +4,7 @@ const (
 	Version = iota
 	V1
 	V2
+	V3
 )
 
 type Scan struct {
@@ -22,3 +23,8 @@ type V1Data struct {
 type V2Data struct {
 	ResponseStr string `json:"response_str"`
 }
+
+type V3Data struct {
+	ResponseBase64 string            `json:"response_base64"`
+	Metadata       map[string]string `json:"metadata"`
+}
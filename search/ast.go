@@ -0,0 +1,88 @@
+package search
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Node is a part of a parsed query which compiles to a SQL condition over scan_entries (aliased as e).
+// Conditions use ? as their placeholders, numbered only once the whole query is rendered.
+type Node interface {
+	condition() (string, []any)
+	String() string
+}
+
+type AndNode struct{ Left, Right Node }
+
+func (n AndNode) condition() (string, []any) {
+	left, leftArgs := n.Left.condition()
+	right, rightArgs := n.Right.condition()
+	return fmt.Sprintf("(%s AND %s)", left, right), append(leftArgs, rightArgs...)
+}
+
+func (n AndNode) String() string { return fmt.Sprintf("(%s and %s)", n.Left, n.Right) }
+
+type OrNode struct{ Left, Right Node }
+
+func (n OrNode) condition() (string, []any) {
+	left, leftArgs := n.Left.condition()
+	right, rightArgs := n.Right.condition()
+	return fmt.Sprintf("(%s OR %s)", left, right), append(leftArgs, rightArgs...)
+}
+
+func (n OrNode) String() string { return fmt.Sprintf("(%s or %s)", n.Left, n.Right) }
+
+type NotNode struct{ Node Node }
+
+func (n NotNode) condition() (string, []any) {
+	cond, args := n.Node.condition()
+	return fmt.Sprintf("NOT %s", cond), args
+}
+
+func (n NotNode) String() string { return fmt.Sprintf("not %s", n.Node) }
+
+// TermNode is a single comparison of a field against a value, already checked and compiled while parsing
+type TermNode struct {
+	Field string
+	Op    Op
+	Value string // As written, for display
+
+	sql  string
+	args []any
+}
+
+func (n TermNode) condition() (string, []any) {
+	return "(" + n.sql + ")", n.args
+}
+
+func (n TermNode) String() string {
+	return n.Field + string(n.Op) + n.Value
+}
+
+// Query is a parsed query, ready to be rendered as SQL
+type Query struct {
+	Source string
+	Root   Node
+}
+
+// SQL renders the query as a condition, appending its parameters to args. Placeholders are numbered after the
+// parameters already in args, so the condition can be combined with others.
+func (q *Query) SQL(args []any) (string, []any) {
+	cond, condArgs := q.Root.condition()
+
+	var sb strings.Builder
+	n := len(args)
+	for _, r := range cond {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&sb, "$%d", n)
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String(), append(args, condArgs...)
+}
+
+func (q *Query) String() string {
+	return q.Root.String()
+}
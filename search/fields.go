@@ -0,0 +1,272 @@
+package search
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Op is how a term compares its field to its value
+type Op string
+
+const (
+	Op_Match Op = ":"  // Equality, containment or pattern match, depending on the field and value
+	Op_Eq    Op = "="  // Same as Op_Match
+	Op_Ne    Op = "!=" // Negated Op_Match
+	Op_Gt    Op = ">"
+	Op_Ge    Op = ">="
+	Op_Lt    Op = "<"
+	Op_Le    Op = "<="
+	Op_Range Op = ":[]" // Between two bounds, written as field:[low TO high]
+)
+
+// timestampLayout formats timestamps for the "timestamp without time zone" columns, as the database package does
+const timestampLayout = "2006-01-02 15:04:05.999999"
+
+// value is a single value as written in a query
+type value struct {
+	text   string
+	quoted bool // Quoted values are taken literally; otherwise * and ? are wildcards
+	pos    int
+}
+
+func (v value) wildcard() bool {
+	return !v.quoted && strings.ContainsAny(v.text, "*?")
+}
+
+func (v value) String() string {
+	if v.quoted {
+		return strconv.Quote(v.text)
+	}
+	return v.text
+}
+
+// bound is one end of a range; a nil value means it is open
+type bound struct {
+	value     *value
+	inclusive bool
+}
+
+type fieldKind int
+
+const (
+	kind_IP      fieldKind = iota
+	kind_Int               // Whole numbers, compared numerically
+	kind_Keyword           // Exact (or wildcard) matches
+	kind_Text              // Substring (or wildcard) matches
+	kind_Time              // Timestamps or dates
+)
+
+type field struct {
+	column          string
+	kind            fieldKind
+	min, max        int64 // For kind_Int
+	caseInsensitive bool  // For kind_Keyword
+}
+
+// fields are what queries can search on, by name
+var fields = map[string]field{
+	"ip":           {column: "e.ip", kind: kind_IP},
+	"port":         {column: "e.port", kind: kind_Int, min: 1, max: 65535},
+	"service":      {column: "e.service", kind: kind_Keyword, caseInsensitive: true},
+	"data":         {column: "e.data", kind: kind_Text},
+	"message_id":   {column: "coalesce(e.message_id, '')", kind: kind_Keyword},
+	"updated":      {column: "e.updated_on", kind: kind_Time},
+	"first_seen":   {column: "e.first_seen", kind: kind_Time},
+	"last_changed": {column: "e.last_changed", kind: kind_Time},
+	"times_seen":   {column: "e.times_seen", kind: kind_Int, min: 0, max: 1<<31 - 1},
+}
+
+// defaultField is searched by terms with no field
+const defaultField = "data"
+
+// FieldNames lists the fields queries can search on
+func FieldNames() []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// likePattern turns a value into an ILIKE pattern; with contains, it may match anywhere
+func likePattern(v value, contains bool) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(v.text)
+	if !v.quoted {
+		escaped = strings.NewReplacer("*", "%", "?", "_").Replace(escaped)
+	}
+	if contains {
+		escaped = "%" + escaped + "%"
+	}
+	return escaped
+}
+
+// compile checks a term and turns it into SQL, or explains what is wrong with it
+func (f field) compile(op Op, v value, low, high bound) (string, []any, error) {
+	switch op {
+	case Op_Match, Op_Eq:
+		return f.match(v)
+	case Op_Ne:
+		cond, args, err := f.match(v)
+		return "NOT (" + cond + ")", args, err
+	case Op_Gt, Op_Ge, Op_Lt, Op_Le:
+		return f.compare(op, v)
+	case Op_Range:
+		conds, args := []string{}, []any{}
+		if low.value != nil {
+			op := Op_Gt
+			if low.inclusive {
+				op = Op_Ge
+			}
+			cond, a, err := f.compare(op, *low.value)
+			if err != nil {
+				return "", nil, err
+			}
+			conds, args = append(conds, cond), append(args, a...)
+		}
+		if high.value != nil {
+			op := Op_Lt
+			if high.inclusive {
+				op = Op_Le
+			}
+			cond, a, err := f.compare(op, *high.value)
+			if err != nil {
+				return "", nil, err
+			}
+			conds, args = append(conds, cond), append(args, a...)
+		}
+		if len(conds) == 0 {
+			return "true", nil, nil
+		}
+		return strings.Join(conds, " AND "), args, nil
+	}
+	return "", nil, fmt.Errorf("unsupported operator %q", op)
+}
+
+func (f field) match(v value) (string, []any, error) {
+	switch f.kind {
+	case kind_IP:
+		if v.wildcard() {
+			return "host(" + f.column + ") LIKE ?", []any{likePattern(v, false)}, nil
+		}
+		if strings.Contains(v.text, "/") {
+			_, network, err := net.ParseCIDR(v.text)
+			if err != nil {
+				return "", nil, fmt.Errorf("%s is not a valid CIDR network", v)
+			}
+			return f.column + " <<= ?::inet", []any{network.String()}, nil
+		}
+		ip, err := f.parseIP(v)
+		if err != nil {
+			return "", nil, err
+		}
+		return f.column + " = ?::inet", []any{ip}, nil
+
+	case kind_Int:
+		n, err := f.parseInt(v)
+		if err != nil {
+			return "", nil, err
+		}
+		return f.column + " = ?", []any{n}, nil
+
+	case kind_Keyword:
+		if v.wildcard() {
+			if f.caseInsensitive {
+				return f.column + " ILIKE ?", []any{likePattern(v, false)}, nil
+			}
+			return f.column + " LIKE ?", []any{likePattern(v, false)}, nil
+		}
+		if f.caseInsensitive {
+			return "lower(" + f.column + ") = lower(?)", []any{v.text}, nil
+		}
+		return f.column + " = ?", []any{v.text}, nil
+
+	case kind_Text:
+		return f.column + " ILIKE ?", []any{likePattern(v, true)}, nil
+
+	case kind_Time:
+		start, end, err := parseTime(v)
+		if err != nil {
+			return "", nil, err
+		}
+		if end.IsZero() {
+			return f.column + " = ?::timestamp", []any{start.Format(timestampLayout)}, nil
+		}
+		return f.column + " >= ?::timestamp AND " + f.column + " < ?::timestamp",
+			[]any{start.Format(timestampLayout), end.Format(timestampLayout)}, nil
+	}
+	return "", nil, fmt.Errorf("unsupported field")
+}
+
+func (f field) compare(op Op, v value) (string, []any, error) {
+	if v.wildcard() {
+		return "", nil, fmt.Errorf("wildcards can't be used with %s", op)
+	}
+
+	switch f.kind {
+	case kind_IP:
+		ip, err := f.parseIP(v)
+		if err != nil {
+			return "", nil, err
+		}
+		return fmt.Sprintf("%s %s ?::inet", f.column, op), []any{ip}, nil
+
+	case kind_Int:
+		n, err := f.parseInt(v)
+		if err != nil {
+			return "", nil, err
+		}
+		return fmt.Sprintf("%s %s ?", f.column, op), []any{n}, nil
+
+	case kind_Time:
+		start, end, err := parseTime(v)
+		if err != nil {
+			return "", nil, err
+		}
+		// A whole day is after a time if it starts after it, and before it if it ends before it
+		t := start
+		if !end.IsZero() && (op == Op_Gt || op == Op_Le) {
+			t = end
+			op = map[Op]Op{Op_Gt: Op_Ge, Op_Le: Op_Lt}[op]
+		}
+		return fmt.Sprintf("%s %s ?::timestamp", f.column, op), []any{t.Format(timestampLayout)}, nil
+	}
+	return "", nil, fmt.Errorf("only supports matching (: or =), not %s", op)
+}
+
+func (f field) parseIP(v value) (string, error) {
+	ip := net.ParseIP(v.text)
+	if ip == nil {
+		return "", fmt.Errorf("%s is not a valid IP address", v)
+	}
+	return ip.String(), nil
+}
+
+func (f field) parseInt(v value) (int64, error) {
+	n, err := strconv.ParseInt(v.text, 10, 64)
+	if err != nil || n < f.min || n > f.max {
+		return 0, fmt.Errorf("%s is not a whole number between %d and %d", v, f.min, f.max)
+	}
+	return n, nil
+}
+
+// parseTime reads a timestamp (RFC 3339 or Unix seconds) or a date. For dates, end is the start of the next day;
+// for timestamps, it is zero.
+func parseTime(v value) (start time.Time, end time.Time, err error) {
+	if unix, err := strconv.ParseInt(v.text, 10, 64); err == nil {
+		return time.Unix(unix, 0), time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", v.text, time.Local); err == nil {
+		return t, t.AddDate(0, 0, 1), nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02T15:04"} {
+		if t, err := time.ParseInLocation(layout, v.text, time.Local); err == nil {
+			return t.Local(), time.Time{}, nil
+		}
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("%s is not a date (2006-01-02), timestamp (2006-01-02T15:04:05Z) or Unix time", v)
+}
@@ -0,0 +1,379 @@
+package search
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+var ErrSyntax = errors.New("query syntax")
+
+// SyntaxError points at what is wrong in a query
+type SyntaxError struct {
+	Query string
+	Pos   int // Byte offset into the query
+	Msg   string
+}
+
+func (e SyntaxError) Error() string {
+	return fmt.Sprintf("%s: %s (at position %d)", ErrSyntax, e.Msg, e.Pos+1)
+}
+
+func (e SyntaxError) Unwrap() error { return ErrSyntax }
+
+// Caret shows the query with a marker under the position of the error
+func (e SyntaxError) Caret() string {
+	return e.Query + "\n" + strings.Repeat(" ", len([]rune(e.Query[:e.Pos]))) + "^"
+}
+
+// Parse reads a query such as:
+//
+//	service:SSH and port:22 and ip:1.1.1.0/24 and data:"OpenSSH_8" and updated>2024-12-01
+//
+// Terms are field:value (or =, !=, >, >=, <, <=), or field:[low TO high] for inclusive ranges ({} for exclusive ends,
+// * for open ones). Unquoted values may use * and ? as wildcards; quoted ones are taken literally. Terms without a
+// field search the data. Terms combine with and, or, not and parentheses; terms next to each other are and-ed.
+func Parse(query string) (*Query, error) {
+	p := &parser{src: query}
+	p.skipSpace()
+	if p.eof() {
+		return nil, p.errorf(p.pos, "empty query")
+	}
+
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if !p.eof() {
+		if p.peek() == ')' {
+			return nil, p.errorf(p.pos, "unexpected ')' without a matching '('")
+		}
+		return nil, p.errorf(p.pos, "unexpected %q", p.rest())
+	}
+	return &Query{Source: query, Root: root}, nil
+}
+
+type parser struct {
+	src string
+	pos int
+}
+
+func (p *parser) errorf(pos int, format string, args ...any) error {
+	return SyntaxError{Query: p.src, Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) eof() bool  { return p.pos >= len(p.src) }
+func (p *parser) peek() byte { return p.src[p.pos] }
+
+// rest is the next few characters, for error messages
+func (p *parser) rest() string {
+	end := strings.IndexFunc(p.src[p.pos:], unicode.IsSpace)
+	if end < 0 {
+		return p.src[p.pos:]
+	}
+	return p.src[p.pos : p.pos+end]
+}
+
+func (p *parser) skipSpace() {
+	for !p.eof() && unicode.IsSpace(rune(p.peek())) {
+		p.pos++
+	}
+}
+
+// keyword consumes one of the boolean keywords (case-insensitively) if it is next, as a whole word
+func (p *parser) keyword(kw string) bool {
+	end := p.pos + len(kw)
+	if end > len(p.src) || !strings.EqualFold(p.src[p.pos:end], kw) {
+		return false
+	}
+	if end < len(p.src) && !unicode.IsSpace(rune(p.src[end])) && p.src[end] != '(' && p.src[end] != '"' {
+		return false
+	}
+	p.pos = end
+	p.skipSpace()
+	return true
+}
+
+func (p *parser) parseOr() (Node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = OrNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (Node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if !p.keyword("and") {
+			// Terms next to each other are and-ed, unless something else comes next
+			if p.eof() || p.peek() == ')' || p.keywordAhead("or") {
+				return left, nil
+			}
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = AndNode{left, right}
+	}
+}
+
+func (p *parser) keywordAhead(kw string) bool {
+	pos := p.pos
+	ok := p.keyword(kw)
+	p.pos = pos
+	return ok
+}
+
+func (p *parser) parseNot() (Node, error) {
+	if p.keyword("not") {
+		node, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return NotNode{node}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Node, error) {
+	if p.eof() {
+		return nil, p.errorf(p.pos, "unexpected end of query, expected a term")
+	}
+
+	switch p.peek() {
+	case '(':
+		open := p.pos
+		p.pos++
+		p.skipSpace()
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.eof() || p.peek() != ')' {
+			return nil, p.errorf(open, "'(' is never closed")
+		}
+		p.pos++
+		p.skipSpace()
+		return node, nil
+	case ')':
+		return nil, p.errorf(p.pos, "unexpected ')', expected a term")
+	}
+
+	for _, kw := range []string{"and", "or"} {
+		if p.keywordAhead(kw) {
+			return nil, p.errorf(p.pos, "unexpected %q, expected a term", kw)
+		}
+	}
+
+	return p.parseTerm()
+}
+
+func (p *parser) parseTerm() (Node, error) {
+	start := p.pos
+
+	// A field name is a run of letters and underscores, right before an operator
+	nameEnd := p.pos
+	for nameEnd < len(p.src) && (unicode.IsLetter(rune(p.src[nameEnd])) || p.src[nameEnd] == '_') {
+		nameEnd++
+	}
+	name := strings.ToLower(p.src[p.pos:nameEnd])
+	if name != "" && nameEnd < len(p.src) && strings.ContainsRune(":=!<>", rune(p.src[nameEnd])) {
+		f, ok := fields[name]
+		if !ok {
+			msg := fmt.Sprintf("unknown field %q", p.src[p.pos:nameEnd])
+			if suggestion := closestField(name); suggestion != "" {
+				msg += fmt.Sprintf(", did you mean %q?", suggestion)
+			} else {
+				msg += fmt.Sprintf(" (fields are %s)", strings.Join(FieldNames(), ", "))
+			}
+			return nil, p.errorf(start, "%s", msg)
+		}
+		p.pos = nameEnd
+		return p.parseFieldTerm(name, f)
+	}
+
+	// Anything else searches the default field
+	v, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	return p.compileTerm(start, defaultField, fields[defaultField], Op_Match, v, bound{}, bound{})
+}
+
+func (p *parser) parseFieldTerm(name string, f field) (Node, error) {
+	start := p.pos - len(name)
+
+	var op Op
+	for _, candidate := range []Op{Op_Ne, Op_Ge, Op_Le, Op_Match, Op_Eq, Op_Gt, Op_Lt} {
+		if strings.HasPrefix(p.src[p.pos:], string(candidate)) {
+			op = candidate
+			break
+		}
+	}
+	if op == "" {
+		return nil, p.errorf(p.pos, "unknown operator, expected one of : = != > >= < <=")
+	}
+	p.pos += len(op)
+
+	if op == Op_Match && !p.eof() && (p.peek() == '[' || p.peek() == '{') {
+		low, high, err := p.parseRange()
+		if err != nil {
+			return nil, err
+		}
+		return p.compileTerm(start, name, f, Op_Range, value{}, low, high)
+	}
+
+	if p.eof() || unicode.IsSpace(rune(p.peek())) || p.peek() == ')' {
+		return nil, p.errorf(p.pos, "expected a value after %s%s", name, op)
+	}
+	v, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	return p.compileTerm(start, name, f, op, v, bound{}, bound{})
+}
+
+func (p *parser) compileTerm(start int, name string, f field, op Op, v value, low, high bound) (Node, error) {
+	sql, args, err := f.compile(op, v, low, high)
+	if err != nil {
+		return nil, p.errorf(start, "%s: %s", name, err)
+	}
+
+	display := v.String()
+	if op == Op_Range {
+		display = p.src[start+len(name)+1 : p.pos]
+		p.skipSpace()
+		return TermNode{Field: name, Op: ":", Value: display, sql: sql, args: args}, nil
+	}
+	p.skipSpace()
+	return TermNode{Field: name, Op: op, Value: display, sql: sql, args: args}, nil
+}
+
+// parseValue reads a quoted string, or anything up to the next space or closing parenthesis
+func (p *parser) parseValue() (value, error) {
+	return p.parseValueUntil(" \t\r\n)")
+}
+
+func (p *parser) parseValueUntil(stop string) (value, error) {
+	start := p.pos
+	if p.peek() == '"' {
+		p.pos++
+		var sb strings.Builder
+		for {
+			if p.eof() {
+				return value{}, p.errorf(start, "unterminated quoted string")
+			}
+			c := p.peek()
+			p.pos++
+			switch c {
+			case '"':
+				return value{text: sb.String(), quoted: true, pos: start}, nil
+			case '\\':
+				if p.eof() {
+					return value{}, p.errorf(start, "unterminated quoted string")
+				}
+				sb.WriteByte(p.peek())
+				p.pos++
+			default:
+				sb.WriteByte(c)
+			}
+		}
+	}
+
+	for !p.eof() && !strings.ContainsRune(stop, rune(p.peek())) {
+		if p.peek() == '"' || p.peek() == '(' {
+			return value{}, p.errorf(p.pos, "unexpected %q inside a value; quote the whole value instead", p.peek())
+		}
+		p.pos++
+	}
+	if p.pos == start {
+		return value{}, p.errorf(start, "expected a value")
+	}
+	return value{text: p.src[start:p.pos], pos: start}, nil
+}
+
+// parseRange reads [low TO high], where either bracket may be a brace for an exclusive end, and either bound may be *
+func (p *parser) parseRange() (low bound, high bound, err error) {
+	open := p.pos
+	low.inclusive = p.peek() == '['
+	p.pos++
+	p.skipSpace()
+
+	readBound := func(b *bound) error {
+		if p.eof() {
+			return p.errorf(open, "range is never closed")
+		}
+		v, err := p.parseValueUntil(" \t\r\n]}")
+		if err != nil {
+			return err
+		}
+		if !v.quoted && v.text == "*" {
+			return nil
+		}
+		b.value = &v
+		return nil
+	}
+
+	if err := readBound(&low); err != nil {
+		return low, high, err
+	}
+	p.skipSpace()
+	if !p.keyword("to") {
+		return low, high, p.errorf(p.pos, "expected TO between the bounds of a range")
+	}
+	if err := readBound(&high); err != nil {
+		return low, high, err
+	}
+	p.skipSpace()
+
+	if p.eof() || (p.peek() != ']' && p.peek() != '}') {
+		return low, high, p.errorf(open, "range is never closed, expected ']' or '}'")
+	}
+	high.inclusive = p.peek() == ']'
+	p.pos++
+	return low, high, nil
+}
+
+// closestField suggests a field for a misspelt one, if any is close enough
+func closestField(name string) string {
+	best, bestDistance := "", 3
+	for _, candidate := range FieldNames() {
+		if d := editDistance(name, candidate); d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,172 @@
+package search
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		query    string
+		wantTree string
+		wantSQL  string
+		wantArgs []any
+	}{
+		{
+			query:    "OpenSSH",
+			wantTree: "data:OpenSSH",
+			wantSQL:  "(e.data ILIKE $1)",
+			wantArgs: []any{"%OpenSSH%"},
+		},
+		{
+			query:    `data:"100%_sure*"`,
+			wantTree: `data:"100%_sure*"`,
+			wantSQL:  "(e.data ILIKE $1)",
+			wantArgs: []any{`%100\%\_sure*%`},
+		},
+		{
+			query:    "service:SSH and port:22",
+			wantTree: "(service:SSH and port:22)",
+			wantSQL:  "((lower(e.service) = lower($1)) AND (e.port = $2))",
+			wantArgs: []any{"SSH", int64(22)},
+		},
+		{
+			query:    "service:HTTP* port!=80",
+			wantTree: "(service:HTTP* and port!=80)",
+			wantSQL:  "((e.service ILIKE $1) AND (NOT (e.port = $2)))",
+			wantArgs: []any{"HTTP%", int64(80)},
+		},
+		{
+			query:    "ip:1.1.1.7/24 or ip=::1",
+			wantTree: "(ip:1.1.1.7/24 or ip=::1)",
+			wantSQL:  "((e.ip <<= $1::inet) OR (e.ip = $2::inet))",
+			wantArgs: []any{"1.1.1.0/24", "::1"},
+		},
+		{
+			query:    "ip:10.0.*",
+			wantTree: "ip:10.0.*",
+			wantSQL:  "(host(e.ip) LIKE $1)",
+			wantArgs: []any{"10.0.%"},
+		},
+		{
+			query:    "a or b and not c",
+			wantTree: "(data:a or (data:b and not data:c))",
+			wantSQL:  "((e.data ILIKE $1) OR ((e.data ILIKE $2) AND NOT (e.data ILIKE $3)))",
+			wantArgs: []any{"%a%", "%b%", "%c%"},
+		},
+		{
+			query:    "(a or b) c",
+			wantTree: "((data:a or data:b) and data:c)",
+			wantSQL:  "(((e.data ILIKE $1) OR (e.data ILIKE $2)) AND (e.data ILIKE $3))",
+			wantArgs: []any{"%a%", "%b%", "%c%"},
+		},
+		{
+			query:    "port:[20 TO 25}",
+			wantTree: "port:[20 TO 25}",
+			wantSQL:  "(e.port >= $1 AND e.port < $2)",
+			wantArgs: []any{int64(20), int64(25)},
+		},
+		{
+			query:    "times_seen:[* TO *]",
+			wantTree: "times_seen:[* TO *]",
+			wantSQL:  "(true)",
+			wantArgs: nil,
+		},
+		{
+			query:    "updated:2024-12-01",
+			wantTree: "updated:2024-12-01",
+			wantSQL:  "(e.updated_on >= $1::timestamp AND e.updated_on < $2::timestamp)",
+			wantArgs: []any{"2024-12-01 00:00:00", "2024-12-02 00:00:00"},
+		},
+		{
+			query:    "updated>2024-12-01 first_seen<=2024-12-01 last_changed<2024-12-01T10:30:00",
+			wantTree: "((updated>2024-12-01 and first_seen<=2024-12-01) and last_changed<2024-12-01T10:30:00)",
+			wantSQL:  "(((e.updated_on >= $1::timestamp) AND (e.first_seen < $2::timestamp)) AND (e.last_changed < $3::timestamp))",
+			wantArgs: []any{"2024-12-02 00:00:00", "2024-12-02 00:00:00", "2024-12-01 10:30:00"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, err := Parse(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tree := q.String(); tree != tt.wantTree {
+				t.Errorf("parsed as %s, want %s", tree, tt.wantTree)
+			}
+			sql, args := q.SQL(nil)
+			if sql != tt.wantSQL {
+				t.Errorf("SQL = %s, want %s", sql, tt.wantSQL)
+			}
+			if fmt.Sprintf("%#v", args) != fmt.Sprintf("%#v", append([]any(nil), tt.wantArgs...)) {
+				t.Errorf("args = %#v, want %#v", args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestQuerySQLNumbersAfterArgs(t *testing.T) {
+	q, err := Parse("port:22 or port:23")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sql, args := q.SQL([]any{"existing"})
+	if want := "((e.port = $2) OR (e.port = $3))"; sql != want {
+		t.Errorf("SQL = %s, want %s", sql, want)
+	}
+	if len(args) != 3 || args[0] != "existing" {
+		t.Errorf("args = %#v, want the existing one followed by the query's", args)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		query   string
+		wantPos int
+		wantMsg string
+	}{
+		{"", 0, "empty query"},
+		{"   ", 3, "empty query"},
+		{"prot:22", 0, `did you mean "port"?`},
+		{"colour:red", 0, "fields are"},
+		{"port:", 5, "expected a value after port:"},
+		{"port:http", 0, "not a whole number between 1 and 65535"},
+		{"port:70000", 0, "not a whole number"},
+		{"port>2*", 0, "wildcards can't be used"},
+		{"service>SSH", 0, "only supports matching"},
+		{"ip:1.2.3", 0, "not a valid IP address"},
+		{"ip:1.2.3.4/99", 0, "not a valid CIDR network"},
+		{"updated:yesterday", 0, "is not a date"},
+		{`data:"open`, 5, "unterminated quoted string"},
+		{"(a or b", 0, "'(' is never closed"},
+		{"a or b)", 6, "without a matching '('"},
+		{"a and or b", 6, `unexpected "or", expected a term`},
+		{"a and", 5, "unexpected end of query"},
+		{"port:[1 25]", 8, "expected TO"},
+		{"port:[1 TO 25", 5, "range is never closed"},
+		{`ab"c`, 2, "quote the whole value"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			_, err := Parse(tt.query)
+			var syntaxErr SyntaxError
+			if !errors.As(err, &syntaxErr) || !errors.Is(err, ErrSyntax) {
+				t.Fatalf("error = %v, want a SyntaxError", err)
+			}
+			if syntaxErr.Pos != tt.wantPos || !strings.Contains(syntaxErr.Msg, tt.wantMsg) {
+				t.Errorf("error at %d: %q; want at %d: %q", syntaxErr.Pos, syntaxErr.Msg, tt.wantPos, tt.wantMsg)
+			}
+		})
+	}
+}
+
+func TestSyntaxErrorCaret(t *testing.T) {
+	err := SyntaxError{Query: "héllo or)", Pos: 9}
+	if want := "héllo or)\n        ^"; err.Caret() != want {
+		t.Errorf("caret = %q, want %q", err.Caret(), want)
+	}
+}
@@ -0,0 +1,583 @@
+package spool
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsufitch/censys-takehome/config"
+	"github.com/fsufitch/censys-takehome/database"
+	"github.com/fsufitch/censys-takehome/logging"
+)
+
+var (
+	ErrSpool   = errors.New("spool")
+	ErrFull    = errors.New("spool full")
+	ErrCorrupt = errors.New("spool corrupt")
+)
+
+// Segment files start with segmentMagic, followed by records. Each record is its payload's length and CRC-32C
+// (big-endian uint32s), then the payload itself: a JSON-encoded entry.
+const (
+	segmentMagic      = "CTSPOOL1"
+	segmentSuffix     = ".seg"
+	corruptSuffix     = ".corrupt"
+	lockName          = "LOCK"
+	recordHeaderSize  = 8
+	maxRecordSize     = 64 << 20 // Anything larger can only be a garbled length
+	defaultSegmentMax = 16 << 20
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Segment is one file of the spool; segments are written and drained in order of their sequence numbers
+type Segment struct {
+	Seq     uint64
+	Path    string
+	Bytes   int64
+	Entries int
+	Problem error // Why the segment could not be read in full, if it could not (only reported by Inspect)
+}
+
+// Stats sums up what is waiting in the spool
+type Stats struct {
+	Segments int
+	Entries  int
+	Bytes    int64 // On disk, including entries of the oldest segment which were already drained
+}
+
+// Spool is a write-ahead log of entries waiting for the database to become available again.
+// Only one process may have a spool directory open at a time.
+type Spool struct {
+	Config config.SpoolConfiguration
+	Log    logging.LogFunc
+
+	mu       sync.Mutex
+	lock     *os.File
+	segments []*Segment // Oldest first; entries are appended to the last one
+	seq      uint64     // Highest sequence number used so far, so that none is ever reused
+	active   *os.File   // The last segment, while it is open for appending; nil once it is sealed
+	drained  int64      // Offset in the oldest segment up to which its entries are already written to the database
+	drainedN int        // Number of entries of the oldest segment which are already written to the database
+
+	draining sync.Mutex
+}
+
+// ProvideSpool opens the configured spool; if no directory is configured, spooling is disabled and it provides nil
+func ProvideSpool(conf config.SpoolConfiguration, logFunc logging.LogFunc) (*Spool, func(), error) {
+	if conf.Dir == "" {
+		return nil, func() {}, nil
+	}
+	s, err := Open(conf, logFunc)
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		logFunc().Info().Str("dir", conf.Dir).Msg("closing spool")
+		if err := s.Close(); err != nil {
+			logFunc().Err(err).Msg("error closing spool")
+		}
+	}
+	return s, cleanup, nil
+}
+
+// Open locks the spool directory (creating it if needed) and checks its segments. A torn write at the end of the
+// newest segment (from a crash while appending, so never acknowledged) is cut off.
+func Open(conf config.SpoolConfiguration, logFunc logging.LogFunc) (*Spool, error) {
+	if conf.SegmentBytes <= 0 {
+		conf.SegmentBytes = defaultSegmentMax
+	}
+	if err := os.MkdirAll(conf.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrSpool, err)
+	}
+
+	lock, err := os.OpenFile(filepath.Join(conf.Dir, lockName), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrSpool, err)
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("%w: %s is in use by another process: %w", ErrSpool, conf.Dir, err)
+	}
+
+	s := &Spool{Config: conf, Log: logFunc, lock: lock}
+	if err := s.load(); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	stats := s.Stats()
+	logFunc().Info().Str("dir", conf.Dir).Int("segments", stats.Segments).Int("entries", stats.Entries).Int64("bytes", stats.Bytes).Msg("opened spool")
+	return s, nil
+}
+
+func (s *Spool) load() error {
+	segments, seq, err := listSegments(s.Config.Dir)
+	if err != nil {
+		return err
+	}
+	s.seq = seq
+
+	for i, seg := range segments {
+		L := s.Log().With().Str("segment", seg.Path).Logger()
+		good, err := scanSegment(seg.Path, func(database.ScanEntry, int64) error {
+			seg.Entries++
+			return nil
+		})
+		switch {
+		case err == nil:
+		case !errors.Is(err, ErrCorrupt):
+			return err
+		case i < len(segments)-1:
+			// Sealed segments were fsynced in full, so this is damage to the disk; what can be read is still drained
+			L.Err(err).Int("entries", seg.Entries).Msg("spool segment is corrupt; only the entries before the damage can be drained")
+		case good < int64(len(segmentMagic)):
+			L.Warn().Err(err).Msg("removing incomplete spool segment")
+			if err := os.Remove(seg.Path); err != nil {
+				return fmt.Errorf("%w: %w", ErrSpool, err)
+			}
+			segments = segments[:i]
+		default:
+			L.Warn().Err(err).Int64("offset", good).Int64("dropped", seg.Bytes-good).Msg("cutting off torn write at the end of the spool")
+			if err := os.Truncate(seg.Path, good); err != nil {
+				return fmt.Errorf("%w: %w", ErrSpool, err)
+			}
+			seg.Bytes = good
+		}
+	}
+
+	s.segments = segments
+	return nil
+}
+
+// Close releases the spool directory; the spool must not be used afterwards
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	if s.active != nil {
+		err = s.active.Close()
+		s.active = nil
+	}
+	if s.lock != nil {
+		err = errors.Join(err, s.lock.Close()) // Closing it also releases the lock
+		s.lock = nil
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrSpool, err)
+	}
+	return nil
+}
+
+// Stats reports what is waiting in the spool; a nil spool (spooling disabled) is always empty
+func (s *Spool) Stats() Stats {
+	if s == nil {
+		return Stats{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := Stats{Segments: len(s.segments), Entries: -s.drainedN}
+	for _, seg := range s.segments {
+		stats.Entries += seg.Entries
+		stats.Bytes += seg.Bytes
+	}
+	return stats
+}
+
+// Append durably adds entries to the end of the spool; once it returns without error, they are on disk
+func (s *Spool) Append(entries ...database.ScanEntry) error {
+	buf := []byte{}
+	for _, e := range entries {
+		var err error
+		if buf, err = appendRecord(buf, e); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.lock == nil {
+		return fmt.Errorf("%w: closed", ErrSpool)
+	}
+	if s.Config.MaxBytes > 0 {
+		total := int64(len(buf))
+		for _, seg := range s.segments {
+			total += seg.Bytes
+		}
+		if total > s.Config.MaxBytes {
+			return fmt.Errorf("%w: %d bytes would exceed the limit of %d", ErrFull, total, s.Config.MaxBytes)
+		}
+	}
+
+	if s.active == nil || (s.last().Entries > 0 && s.last().Bytes+int64(len(buf)) > s.Config.SegmentBytes) {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	seg := s.last()
+	_, err := s.active.Write(buf)
+	if err == nil {
+		err = s.active.Sync()
+	}
+	if err != nil {
+		// Don't leave a partial record behind for the next append to follow
+		if truncErr := s.active.Truncate(seg.Bytes); truncErr != nil {
+			s.Log().Err(truncErr).Str("segment", seg.Path).Msg("failed to undo partial append; sealing segment")
+			s.active.Close()
+			s.active = nil
+		}
+		return fmt.Errorf("%w: append failed: %w", ErrSpool, err)
+	}
+
+	seg.Bytes += int64(len(buf))
+	seg.Entries += len(entries)
+	return nil
+}
+
+func (s *Spool) last() *Segment {
+	return s.segments[len(s.segments)-1]
+}
+
+// rotate seals the current segment, if any, and starts a new one
+func (s *Spool) rotate() error {
+	if s.active != nil {
+		if err := s.active.Close(); err != nil {
+			return fmt.Errorf("%w: %w", ErrSpool, err)
+		}
+		s.active = nil
+	}
+
+	s.seq++
+	seq := s.seq
+	path := filepath.Join(s.Config.Dir, segmentName(seq))
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrSpool, err)
+	}
+	if _, err := f.Write([]byte(segmentMagic)); err != nil {
+		f.Close()
+		return fmt.Errorf("%w: %w", ErrSpool, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("%w: %w", ErrSpool, err)
+	}
+	if err := syncDir(s.Config.Dir); err != nil {
+		f.Close()
+		return err
+	}
+
+	s.Log().Debug().Str("segment", path).Msg("started spool segment")
+	s.active = f
+	s.segments = append(s.segments, &Segment{Seq: seq, Path: path, Bytes: int64(len(segmentMagic))})
+	return nil
+}
+
+// Drain hands spooled entries to write in chunks, oldest first, removing each segment once all of it is written.
+// It stops at the first failed write; the entries of that chunk stay spooled, to be drained again later. Entries
+// appended while draining are left for the next call.
+func (s *Spool) Drain(ctx context.Context, chunk int, write func(context.Context, []database.ScanEntry) error) (int, error) {
+	if chunk < 1 {
+		chunk = 1
+	}
+	s.draining.Lock()
+	defer s.draining.Unlock()
+
+	s.mu.Lock()
+	stop := uint64(0)
+	if len(s.segments) > 0 {
+		stop = s.last().Seq
+	}
+	s.mu.Unlock()
+
+	drained := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return drained, fmt.Errorf("%w: interrupted: %w", ErrSpool, err)
+		}
+
+		s.mu.Lock()
+		if len(s.segments) == 0 || s.segments[0].Seq > stop {
+			s.mu.Unlock()
+			return drained, nil
+		}
+		seg := s.segments[0]
+		if len(s.segments) == 1 && s.active != nil {
+			// Seal it, so new entries go to a new segment while this one is drained
+			if err := s.active.Close(); err != nil {
+				s.mu.Unlock()
+				return drained, fmt.Errorf("%w: %w", ErrSpool, err)
+			}
+			s.active = nil
+		}
+		from := s.drained
+		s.mu.Unlock()
+
+		batch := make([]database.ScanEntry, 0, chunk)
+		var end int64
+		flush := func() error {
+			if len(batch) == 0 {
+				return nil
+			}
+			if err := write(ctx, batch); err != nil {
+				return err
+			}
+			s.mu.Lock()
+			s.drained = end
+			s.drainedN += len(batch)
+			s.mu.Unlock()
+			drained += len(batch)
+			batch = batch[:0]
+			return nil
+		}
+
+		_, err := scanSegment(seg.Path, func(e database.ScanEntry, next int64) error {
+			if next <= from {
+				return nil
+			}
+			batch, end = append(batch, e), next
+			if len(batch) < chunk {
+				return nil
+			}
+			return flush()
+		})
+		corrupt := errors.Is(err, ErrCorrupt)
+		if err != nil && !corrupt {
+			return drained, err
+		}
+		if err := flush(); err != nil {
+			return drained, err
+		}
+
+		if err := s.removeHead(seg, corrupt); err != nil {
+			return drained, err
+		}
+	}
+}
+
+// removeHead deletes the oldest segment once it is drained, or sets it aside if it was corrupt
+func (s *Spool) removeHead(seg *Segment, corrupt bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	if corrupt {
+		s.Log().Error().Str("segment", seg.Path).Msg("setting aside corrupt spool segment; entries after the damage are lost")
+		err = os.Rename(seg.Path, seg.Path+corruptSuffix)
+	} else {
+		err = os.Remove(seg.Path)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrSpool, err)
+	}
+
+	s.segments = s.segments[1:]
+	s.drained, s.drainedN = 0, 0
+	s.Log().Debug().Str("segment", seg.Path).Int("entries", seg.Entries).Msg("drained spool segment")
+	return syncDir(s.Config.Dir)
+}
+
+// Inspect reads a spool directory without opening (or locking) it, calling fn (if not nil) for every readable entry
+func Inspect(dir string, fn func(*Segment, database.ScanEntry) error) ([]*Segment, error) {
+	segments, _, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, seg := range segments {
+		_, err := scanSegment(seg.Path, func(e database.ScanEntry, _ int64) error {
+			seg.Entries++
+			if fn == nil {
+				return nil
+			}
+			return fn(seg, e)
+		})
+		if errors.Is(err, ErrCorrupt) {
+			seg.Problem = err
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return segments, nil
+}
+
+func segmentName(seq uint64) string {
+	return fmt.Sprintf("%020d%s", seq, segmentSuffix)
+}
+
+// listSegments finds the segments in a directory, along with the highest sequence number used by any segment file
+// (including ones set aside as corrupt)
+func listSegments(dir string) ([]*Segment, uint64, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %w", ErrSpool, err)
+	}
+
+	segments := []*Segment{}
+	maxSeq := uint64(0)
+	for _, file := range files {
+		name := file.Name()
+		corrupt := strings.HasSuffix(name, segmentSuffix+corruptSuffix)
+		if file.IsDir() || !(corrupt || strings.HasSuffix(name, segmentSuffix)) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimSuffix(name, corruptSuffix), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		maxSeq = max(maxSeq, seq)
+		if corrupt {
+			continue
+		}
+
+		info, err := file.Info()
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: %w", ErrSpool, err)
+		}
+		segments = append(segments, &Segment{Seq: seq, Path: filepath.Join(dir, name), Bytes: info.Size()})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].Seq < segments[j].Seq })
+	return segments, maxSeq, nil
+}
+
+// scanSegment reads a segment's records in order, calling fn with each entry and the offset just past its record.
+// If a record is incomplete or damaged, it stops there with ErrCorrupt; good is the offset where that record starts.
+func scanSegment(path string, fn func(database.ScanEntry, int64) error) (good int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrSpool, err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	readFull := func(buf []byte, what string, offset int64) error {
+		_, err := io.ReadFull(r, buf)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("%w: %s: incomplete %s at offset %d", ErrCorrupt, path, what, offset)
+		} else if err != nil {
+			return fmt.Errorf("%w: %w", ErrSpool, err)
+		}
+		return nil
+	}
+
+	magic := make([]byte, len(segmentMagic))
+	if err := readFull(magic, "segment header", 0); err != nil {
+		return 0, err
+	}
+	if string(magic) != segmentMagic {
+		return 0, fmt.Errorf("%w: %s: not a spool segment", ErrCorrupt, path)
+	}
+
+	offset := int64(len(segmentMagic))
+	header := make([]byte, recordHeaderSize)
+	for {
+		if _, err := r.Peek(1); errors.Is(err, io.EOF) {
+			return offset, nil
+		}
+		if err := readFull(header, "record header", offset); err != nil {
+			return offset, err
+		}
+		size, sum := binary.BigEndian.Uint32(header[0:4]), binary.BigEndian.Uint32(header[4:8])
+		if size > maxRecordSize {
+			return offset, fmt.Errorf("%w: %s: bad record length %d at offset %d", ErrCorrupt, path, size, offset)
+		}
+		payload := make([]byte, size)
+		if err := readFull(payload, "record", offset); err != nil {
+			return offset, err
+		}
+		if crc32.Checksum(payload, crcTable) != sum {
+			return offset, fmt.Errorf("%w: %s: checksum mismatch at offset %d", ErrCorrupt, path, offset)
+		}
+		entry, err := decodeRecord(payload)
+		if err != nil {
+			return offset, fmt.Errorf("%w: %s: bad record at offset %d: %w", ErrCorrupt, path, offset, err)
+		}
+
+		offset += recordHeaderSize + int64(size)
+		if err := fn(entry, offset); err != nil {
+			return offset, err
+		}
+	}
+}
+
+type record struct {
+	IP        string    `json:"ip"`
+	Port      uint32    `json:"port"`
+	Service   string    `json:"service"`
+	Updated   time.Time `json:"updated"`
+	Data      string    `json:"data"`
+	Raw       []byte    `json:"raw,omitempty"`
+	Encoding  string    `json:"encoding,omitempty"`
+	MessageID string    `json:"message_id,omitempty"`
+
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+func appendRecord(buf []byte, e database.ScanEntry) ([]byte, error) {
+	payload, err := json.Marshal(record{
+		IP:        e.IP.String(),
+		Port:      e.Port,
+		Service:   e.Service,
+		Updated:   e.Updated,
+		Data:      e.Data,
+		Raw:       e.Raw,
+		Encoding:  e.Encoding,
+		MessageID: e.MessageID,
+		Metadata:  e.Metadata,
+	})
+	if err != nil {
+		return buf, fmt.Errorf("%w: encoding entry failed: %w", ErrSpool, err)
+	}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(payload)))
+	buf = binary.BigEndian.AppendUint32(buf, crc32.Checksum(payload, crcTable))
+	return append(buf, payload...), nil
+}
+
+func decodeRecord(payload []byte) (database.ScanEntry, error) {
+	r := record{}
+	if err := json.Unmarshal(payload, &r); err != nil {
+		return database.ScanEntry{}, err
+	}
+	return database.ScanEntry{
+		IP:        net.ParseIP(r.IP),
+		Port:      r.Port,
+		Service:   r.Service,
+		Updated:   r.Updated,
+		Data:      r.Data,
+		Raw:       r.Raw,
+		Encoding:  r.Encoding,
+		MessageID: r.MessageID,
+		Metadata:  r.Metadata,
+	}, nil
+}
+
+// syncDir makes file creations, renames and removals in a directory durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrSpool, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("%w: %w", ErrSpool, err)
+	}
+	return nil
+}
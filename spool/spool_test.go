@@ -0,0 +1,258 @@
+package spool
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fsufitch/censys-takehome/config"
+	"github.com/fsufitch/censys-takehome/database"
+	"github.com/fsufitch/censys-takehome/logging"
+	"github.com/rs/zerolog"
+)
+
+func openTestSpool(t *testing.T, dir string) *Spool {
+	t.Helper()
+	nop := zerolog.Nop()
+	s, err := Open(config.SpoolConfiguration{Dir: dir}, logging.LogFunc(func() *zerolog.Logger { return &nop }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func testEntries(n int) []database.ScanEntry {
+	entries := make([]database.ScanEntry, n)
+	for i := range entries {
+		entries[i] = database.ScanEntry{
+			IP:        net.ParseIP("1.2.3.4"),
+			Port:      uint32(i + 1),
+			Service:   "HTTP",
+			Updated:   time.Unix(1700000000+int64(i), 0).UTC(),
+			Data:      fmt.Sprintf("response %d", i),
+			MessageID: fmt.Sprintf("msg-%d", i),
+		}
+	}
+	return entries
+}
+
+// drainAll drains the whole spool, returning the entries in the order they were handed over
+func drainAll(t *testing.T, s *Spool) []database.ScanEntry {
+	t.Helper()
+	drained := []database.ScanEntry{}
+	if _, err := s.Drain(context.Background(), 2, func(_ context.Context, entries []database.ScanEntry) error {
+		drained = append(drained, entries...)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return drained
+}
+
+func onlySegment(t *testing.T, dir string) string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("segments = %v (%v), want exactly one", paths, err)
+	}
+	return paths[0]
+}
+
+func TestSpoolRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	entries := testEntries(5)
+	entries[0].Raw, entries[0].Encoding = []byte{0xFF, 0xFE, 'h', 0}, "utf-16le"
+	entries[1].Metadata = map[string]string{"tls": "1.3"}
+
+	s := openTestSpool(t, dir)
+	if err := s.Append(entries[:3]...); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Append(entries[3:]...); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s = openTestSpool(t, dir)
+	if stats := s.Stats(); stats.Entries != len(entries) {
+		t.Errorf("reopened spool has %d entries, want %d", stats.Entries, len(entries))
+	}
+	if drained := drainAll(t, s); !reflect.DeepEqual(drained, entries) {
+		t.Errorf("drained %+v, want %+v", drained, entries)
+	}
+	if stats := s.Stats(); stats != (Stats{}) {
+		t.Errorf("stats after draining = %+v, want empty", stats)
+	}
+}
+
+func TestSpoolDrainFailure(t *testing.T) {
+	s := openTestSpool(t, t.TempDir())
+	entries := testEntries(4)
+	if err := s.Append(entries...); err != nil {
+		t.Fatal(err)
+	}
+
+	errDown := errors.New("database down")
+	calls := 0
+	drained, err := s.Drain(context.Background(), 2, func(context.Context, []database.ScanEntry) error {
+		if calls++; calls > 1 {
+			return errDown
+		}
+		return nil
+	})
+	if !errors.Is(err, errDown) || drained != 2 {
+		t.Fatalf("drain = %d, %v; want 2, %v", drained, err, errDown)
+	}
+	if stats := s.Stats(); stats.Entries != 2 {
+		t.Errorf("%d entries left after a failed drain, want 2", stats.Entries)
+	}
+	if rest := drainAll(t, s); !reflect.DeepEqual(rest, entries[2:]) {
+		t.Errorf("drained %+v after the failure, want %+v", rest, entries[2:])
+	}
+}
+
+func TestSpoolDamage(t *testing.T) {
+	tests := []struct {
+		name string
+		// damage changes the segment's bytes, where the first record starts at offset 8 and is n bytes long
+		damage      func(data []byte, n int) []byte
+		wantEntries int
+	}{
+		{
+			name:        "torn record header",
+			damage:      func(data []byte, n int) []byte { return data[:len(data)-recordLen(data, 2)+3] },
+			wantEntries: 2,
+		},
+		{
+			name:        "torn record payload",
+			damage:      func(data []byte, n int) []byte { return data[:len(data)-5] },
+			wantEntries: 2,
+		},
+		{
+			name: "checksum mismatch",
+			damage: func(data []byte, n int) []byte {
+				data[len(segmentMagic)+n+recordHeaderSize+2] ^= 0xFF // Inside the second record's payload
+				return data
+			},
+			wantEntries: 1,
+		},
+		{
+			name:        "incomplete segment header",
+			damage:      func(data []byte, n int) []byte { return data[:3] },
+			wantEntries: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			entries := testEntries(3)
+			s := openTestSpool(t, dir)
+			if err := s.Append(entries...); err != nil {
+				t.Fatal(err)
+			}
+			s.Close()
+
+			path := onlySegment(t, dir)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = tt.damage(data, recordLen(data, 0))
+			if err := os.WriteFile(path, data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			// Opening cuts off the damage at the end of the newest segment, so the spool can be appended to again
+			s = openTestSpool(t, dir)
+			if stats := s.Stats(); stats.Entries != tt.wantEntries {
+				t.Errorf("reopened spool has %d entries, want %d", stats.Entries, tt.wantEntries)
+			}
+			if _, err := Inspect(dir, nil); err != nil {
+				t.Error(err)
+			}
+			extra := testEntries(4)[3]
+			if err := s.Append(extra); err != nil {
+				t.Fatal(err)
+			}
+
+			want := append(append([]database.ScanEntry{}, entries[:tt.wantEntries]...), extra)
+			if drained := drainAll(t, s); !reflect.DeepEqual(drained, want) {
+				t.Errorf("drained %+v, want %+v", drained, want)
+			}
+		})
+	}
+}
+
+func TestSpoolCorruptSealedSegment(t *testing.T) {
+	dir := t.TempDir()
+	entries := testEntries(3)
+	extra := testEntries(4)[3]
+	s := openTestSpool(t, dir)
+	if err := s.Append(entries...); err != nil {
+		t.Fatal(err)
+	}
+	path := onlySegment(t, dir)
+	// Seal the segment by starting a newer one
+	s.mu.Lock()
+	err := s.rotate()
+	s.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Append(extra); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// Damage the middle record of the sealed segment
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(segmentMagic)+recordLen(data, 0)+recordHeaderSize+2] ^= 0xFF
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s = openTestSpool(t, dir)
+	if stats := s.Stats(); stats.Entries != 2 {
+		t.Errorf("reopened spool has %d entries, want 2", stats.Entries)
+	}
+
+	segments, err := Inspect(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 2 || !errors.Is(segments[0].Problem, ErrCorrupt) || segments[1].Problem != nil {
+		t.Fatalf("inspected segments %+v, want the first of two to be corrupt", segments)
+	}
+
+	// What can be read is drained, and the rest is set aside rather than deleted
+	want := []database.ScanEntry{entries[0], extra}
+	if drained := drainAll(t, s); !reflect.DeepEqual(drained, want) {
+		t.Errorf("drained %+v, want %+v", drained, want)
+	}
+	if _, err := os.Stat(path + corruptSuffix); err != nil {
+		t.Errorf("corrupt segment was not set aside: %v", err)
+	}
+}
+
+// recordLen reads the length of the i-th record of a segment, including its header
+func recordLen(data []byte, i int) int {
+	offset := len(segmentMagic)
+	for {
+		n := recordHeaderSize + int(binary.BigEndian.Uint32(data[offset:]))
+		if i == 0 {
+			return n
+		}
+		offset, i = offset+n, i-1
+	}
+}
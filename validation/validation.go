@@ -0,0 +1,112 @@
+package validation
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/fsufitch/censys-takehome/config"
+)
+
+var ErrValidation = errors.New("validation error")
+
+// Fields which are validated
+const (
+	Field_IP        = "ip"
+	Field_Port      = "port"
+	Field_Service   = "service"
+	Field_Timestamp = "timestamp"
+)
+
+// Reasons for a field to be invalid
+const (
+	Reason_Missing    = "missing"
+	Reason_Malformed  = "malformed"
+	Reason_OutOfRange = "out_of_range"
+	Reason_NotAllowed = "not_allowed"
+	Reason_InFuture   = "in_future"
+	Reason_TooOld     = "too_old"
+)
+
+// FieldError describes why a single field is invalid; it always matches ErrValidation
+type FieldError struct {
+	Field  string
+	Reason string
+	Value  string
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("%s: %s is %s (%q)", ErrValidation, e.Field, strings.ReplaceAll(e.Reason, "_", " "), e.Value)
+}
+
+func (e FieldError) Unwrap() error {
+	return ErrValidation
+}
+
+// Validator checks incoming scan fields according to the configured policy
+type Validator struct {
+	Config config.ValidationConfiguration
+	Now    func() time.Time
+}
+
+func ProvideValidator(conf config.ValidationConfiguration) *Validator {
+	return &Validator{Config: conf, Now: time.Now}
+}
+
+func (v *Validator) IP(s string) (net.IP, error) {
+	if s == "" {
+		return nil, FieldError{Field: Field_IP, Reason: Reason_Missing}
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, FieldError{Field: Field_IP, Reason: Reason_Malformed, Value: s}
+	}
+	if ip.IsUnspecified() {
+		return nil, FieldError{Field: Field_IP, Reason: Reason_NotAllowed, Value: s}
+	}
+	return ip, nil
+}
+
+func (v *Validator) Port(port uint32) error {
+	if port == 0 || port > 65535 {
+		return FieldError{Field: Field_Port, Reason: Reason_OutOfRange, Value: fmt.Sprint(port)}
+	}
+	return nil
+}
+
+func (v *Validator) Service(service string) error {
+	if strings.TrimSpace(service) == "" {
+		return FieldError{Field: Field_Service, Reason: Reason_Missing, Value: service}
+	}
+	if len(v.Config.AllowedServices) == 0 {
+		return nil
+	}
+	for _, allowed := range v.Config.AllowedServices {
+		if strings.EqualFold(service, allowed) {
+			return nil
+		}
+	}
+	return FieldError{Field: Field_Service, Reason: Reason_NotAllowed, Value: service}
+}
+
+func (v *Validator) Timestamp(timestamp int64) (time.Time, error) {
+	// An absent timestamp decodes as 0; anything before the epoch is there, but can't be a scan's
+	if timestamp == 0 {
+		return time.Time{}, FieldError{Field: Field_Timestamp, Reason: Reason_Missing, Value: fmt.Sprint(timestamp)}
+	}
+	if timestamp < 0 {
+		return time.Time{}, FieldError{Field: Field_Timestamp, Reason: Reason_OutOfRange, Value: fmt.Sprint(timestamp)}
+	}
+
+	t := time.Unix(timestamp, 0)
+	now := v.Now()
+	if t.After(now.Add(v.Config.MaxClockSkew)) {
+		return time.Time{}, FieldError{Field: Field_Timestamp, Reason: Reason_InFuture, Value: t.Format(time.RFC3339)}
+	}
+	if v.Config.MaxAge > 0 && t.Before(now.Add(-v.Config.MaxAge)) {
+		return time.Time{}, FieldError{Field: Field_Timestamp, Reason: Reason_TooOld, Value: t.Format(time.RFC3339)}
+	}
+	return t, nil
+}
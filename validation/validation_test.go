@@ -0,0 +1,130 @@
+package validation
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fsufitch/censys-takehome/config"
+)
+
+// checkFieldError fails unless err is a FieldError with the given reason, or nil if reason is empty
+func checkFieldError(t *testing.T, err error, field, reason string) {
+	t.Helper()
+	if reason == "" {
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		return
+	}
+	var fieldErr FieldError
+	if !errors.As(err, &fieldErr) {
+		t.Fatalf("error = %v, want a FieldError", err)
+	}
+	if !errors.Is(err, ErrValidation) {
+		t.Errorf("error %v does not match ErrValidation", err)
+	}
+	if fieldErr.Field != field || fieldErr.Reason != reason {
+		t.Errorf("error is for %s (%s), want %s (%s)", fieldErr.Field, fieldErr.Reason, field, reason)
+	}
+}
+
+func TestValidatorIP(t *testing.T) {
+	tests := []struct {
+		ip         string
+		wantReason string
+	}{
+		{"1.2.3.4", ""},
+		{"2001:db8::1", ""},
+		{"", Reason_Missing},
+		{"1.2.3", Reason_Malformed},
+		{"example.com", Reason_Malformed},
+		{"0.0.0.0", Reason_NotAllowed},
+		{"::", Reason_NotAllowed},
+	}
+
+	v := ProvideValidator(config.ValidationConfiguration{})
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			ip, err := v.IP(tt.ip)
+			checkFieldError(t, err, Field_IP, tt.wantReason)
+			if err == nil && ip == nil {
+				t.Error("valid IP was not returned")
+			}
+		})
+	}
+}
+
+func TestValidatorPort(t *testing.T) {
+	tests := []struct {
+		port       uint32
+		wantReason string
+	}{
+		{1, ""},
+		{443, ""},
+		{65535, ""},
+		{0, Reason_OutOfRange},
+		{65536, Reason_OutOfRange},
+	}
+
+	v := ProvideValidator(config.ValidationConfiguration{})
+	for _, tt := range tests {
+		checkFieldError(t, v.Port(tt.port), Field_Port, tt.wantReason)
+	}
+}
+
+func TestValidatorService(t *testing.T) {
+	tests := []struct {
+		name       string
+		allowed    []string
+		service    string
+		wantReason string
+	}{
+		{"any service", nil, "HTTP", ""},
+		{"empty", nil, "", Reason_Missing},
+		{"blank", nil, "  ", Reason_Missing},
+		{"allowed", []string{"HTTP", "SSH"}, "ssh", ""},
+		{"not allowed", []string{"HTTP", "SSH"}, "DNS", Reason_NotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := ProvideValidator(config.ValidationConfiguration{AllowedServices: tt.allowed})
+			checkFieldError(t, v.Service(tt.service), Field_Service, tt.wantReason)
+		})
+	}
+}
+
+func TestValidatorTimestamp(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		maxAge     time.Duration
+		timestamp  int64
+		wantReason string
+	}{
+		{"now", 0, now.Unix(), ""},
+		{"missing", 0, 0, Reason_Missing},
+		{"negative", 0, -1, Reason_OutOfRange},
+		{"within clock skew", 0, now.Add(time.Minute).Unix(), ""},
+		{"in future", 0, now.Add(time.Hour).Unix(), Reason_InFuture},
+		{"old without max age", 0, 1, ""},
+		{"within max age", 24 * time.Hour, now.Add(-23 * time.Hour).Unix(), ""},
+		{"too old", 24 * time.Hour, now.Add(-25 * time.Hour).Unix(), Reason_TooOld},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &Validator{
+				Config: config.ValidationConfiguration{MaxClockSkew: 5 * time.Minute, MaxAge: tt.maxAge},
+				Now:    func() time.Time { return now },
+			}
+			ts, err := v.Timestamp(tt.timestamp)
+			checkFieldError(t, err, Field_Timestamp, tt.wantReason)
+			if err == nil && ts.Unix() != tt.timestamp {
+				t.Errorf("timestamp = %v, want %d", ts, tt.timestamp)
+			}
+		})
+	}
+}